@@ -0,0 +1,35 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// acceptorPacketConn is the UDP socket of an additional acceptor sharing a
+// port through SO_REUSEPORT. quic-go refuses to serve two sockets reporting
+// the same local address (see quic-go/quic-go#3727), so the address reported
+// for each acceptor carries its index in the zone. Giving each socket its own
+// quic.Transport doesn't help: the check is made for every Transport, up to
+// quic-go v0.54.
+type acceptorPacketConn struct {
+	*net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (c *acceptorPacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// newAcceptorPacketConn returns pc as the UDP socket of the i'th acceptor.
+func newAcceptorPacketConn(pc net.PacketConn, i int) net.PacketConn {
+	udpConn, ok := pc.(*net.UDPConn)
+	if !ok || i == 0 {
+		return pc
+	}
+
+	addr := *udpConn.LocalAddr().(*net.UDPAddr)
+	addr.Zone = fmt.Sprintf("%s#%d", addr.Zone, i)
+	return &acceptorPacketConn{UDPConn: udpConn, addr: &addr}
+}
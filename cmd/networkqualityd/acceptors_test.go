@@ -0,0 +1,105 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestAcceptorPacketConns(t *testing.T) {
+	const acceptors, clients = 4, 20
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Borrow the certificate of httptest, which is valid for 127.0.0.1.
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	serverTLS := &tls.Config{Certificates: certServer.TLS.Certificates, NextProtos: []string{"nq-test"}}
+	clientTLS := &tls.Config{RootCAs: roots, NextProtos: []string{"nq-test"}}
+
+	lc := net.ListenConfig{Control: func(network, address string, conn syscall.RawConn) error {
+		return setReusePort(conn)
+	}}
+	var addr *net.UDPAddr
+	accepted := make([]int, acceptors)
+	var mut sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < acceptors; i++ {
+		address := "127.0.0.1:0"
+		if addr != nil {
+			address = addr.String()
+		}
+		pc, err := lc.ListenPacket(ctx, "udp", address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer pc.Close()
+		if addr == nil {
+			addr = pc.LocalAddr().(*net.UDPAddr)
+		}
+
+		// quic-go panics if two sockets report the same address.
+		apc := newAcceptorPacketConn(pc, i)
+		if got := apc.LocalAddr().(*net.UDPAddr); !got.IP.Equal(addr.IP) || got.Port != addr.Port {
+			t.Errorf("acceptor %d reports address %s, want %s", i, got, addr)
+		}
+		ln, err := quic.ListenEarly(apc, serverTLS, nil)
+		if err != nil {
+			t.Fatalf("acceptor %d: %v", i, err)
+		}
+		defer ln.Close()
+
+		wg.Add(1)
+		go func(i int, ln *quic.EarlyListener) {
+			defer wg.Done()
+			for {
+				conn, err := ln.Accept(ctx)
+				if err != nil {
+					return
+				}
+				mut.Lock()
+				accepted[i]++
+				mut.Unlock()
+				conn.CloseWithError(0, "")
+			}
+		}(i, ln)
+	}
+
+	// Each client has its own socket, which the kernel hashes to one of the
+	// acceptors.
+	for i := 0; i < clients; i++ {
+		conn, err := quic.DialAddr(ctx, addr.String(), clientTLS, nil)
+		if err != nil {
+			t.Fatalf("client %d: %v", i, err)
+		}
+		<-conn.Context().Done()
+	}
+	cancel()
+	wg.Wait()
+
+	total, serving := 0, 0
+	for _, n := range accepted {
+		total += n
+		if n > 0 {
+			serving++
+		}
+	}
+	if total != clients || serving < 2 {
+		t.Errorf("acceptors accepted %v connections, want %d spread across them", accepted, clients)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// listenFdsStart is the first file descriptor passed by the service
+// manager (SD_LISTEN_FDS_START in sd-daemon.h).
+const listenFdsStart = 3
+
+var errUnsupportedSocket = errors.New("not a TCP listener or UDP socket")
+
+// activatedSockets holds the sockets handed to us through the systemd
+// socket activation protocol (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES).
+// They are looked up by port and stand in for the sockets networkqualityd
+// would otherwise bind itself.
+//
+// A networkqualityd started by an upgrade (see upgrade.go) receives its
+// sockets the same way, along with the pipes used to coordinate the
+// handoff with its parent.
+type activatedSockets struct {
+	listeners   map[int][]net.Listener
+	packetConns map[int][]net.PacketConn
+
+	ready    *os.File
+	released chan struct{}
+}
+
+// activatedSocketsFromEnv collects the sockets passed to this process, if
+// any. It returns an empty set when the process was not socket activated.
+func activatedSocketsFromEnv() (*activatedSockets, error) {
+	s := &activatedSockets{
+		listeners:   make(map[int][]net.Listener),
+		packetConns: make(map[int][]net.PacketConn),
+		released:    make(chan struct{}),
+	}
+
+	// An upgrading parent can't know our pid in advance, so it identifies
+	// itself instead.
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		ppid, err := strconv.Atoi(os.Getenv(upgradeParentEnv))
+		if err != nil || ppid != os.Getppid() {
+			close(s.released)
+			return s, nil
+		}
+	}
+
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		close(s.released)
+		return s, nil
+	}
+	names := listenFdNames(nfds, os.Getenv("LISTEN_FDNAMES"))
+
+	// The sockets are ours now; don't let them leak into any child process.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	os.Unsetenv(upgradeParentEnv)
+
+	var release *os.File
+	for i, name := range names {
+		switch f := os.NewFile(uintptr(listenFdsStart+i), name); name {
+		case upgradeReadyName:
+			s.ready = f
+		case upgradeReleaseName:
+			release = f
+		default:
+			if err := s.add(f); err != nil {
+				return nil, fmt.Errorf("inherited socket %q: %w", name, err)
+			}
+		}
+	}
+
+	if release == nil {
+		close(s.released)
+		return s, nil
+	}
+
+	// The parent closes its end once it no longer reads from the UDP sockets
+	// it shares with us (or when it exits).
+	go func() {
+		_, _ = io.Copy(io.Discard, release)
+		release.Close()
+		close(s.released)
+	}()
+
+	return s, nil
+}
+
+// listenFdNames returns the names of the nfds descriptors passed with
+// LISTEN_FDNAMES, a colon separated list. Descriptors it doesn't name are
+// called after their number, e.g. "fd3".
+func listenFdNames(nfds int, fdnames string) []string {
+	names := strings.Split(fdnames, ":")
+	result := make([]string, nfds)
+	for i := range result {
+		result[i] = fmt.Sprintf("fd%d", listenFdsStart+i)
+		if i < len(names) && len(names[i]) > 0 {
+			result[i] = names[i]
+		}
+	}
+	return result
+}
+
+// add takes ownership of f. The net package duplicates the descriptor, so f
+// is always closed.
+func (s *activatedSockets) add(f *os.File) error {
+	defer f.Close()
+
+	if l, err := net.FileListener(f); err == nil {
+		port, err := addrPort(l.Addr())
+		if err != nil {
+			l.Close()
+			return err
+		}
+		s.listeners[port] = append(s.listeners[port], l)
+		return nil
+	}
+
+	if pc, err := net.FilePacketConn(f); err == nil {
+		port, err := addrPort(pc.LocalAddr())
+		if err != nil {
+			pc.Close()
+			return err
+		}
+		s.packetConns[port] = append(s.packetConns[port], pc)
+		return nil
+	}
+
+	return errUnsupportedSocket
+}
+
+// listener returns an inherited TCP listener bound to port, or nil.
+func (s *activatedSockets) listener(port int) net.Listener {
+	l := s.listeners[port]
+	if len(l) == 0 {
+		return nil
+	}
+	s.listeners[port] = l[1:]
+	return l[0]
+}
+
+// packetConn returns an inherited UDP socket bound to port, or nil.
+func (s *activatedSockets) packetConn(port int) net.PacketConn {
+	pc := s.packetConns[port]
+	if len(pc) == 0 {
+		return nil
+	}
+	s.packetConns[port] = pc[1:]
+	return pc[0]
+}
+
+// waitReleased blocks until the inherited UDP sockets are no longer being
+// served by an upgrading parent. QUIC connection state can't be handed over,
+// so only one process may read from a shared UDP socket at a time.
+func (s *activatedSockets) waitReleased() {
+	<-s.released
+}
+
+// notifyReady tells an upgrading parent that we are serving, so that it can
+// stop accepting connections and drain.
+func (s *activatedSockets) notifyReady() {
+	if s.ready == nil {
+		return
+	}
+	if _, err := s.ready.Write([]byte{1}); err != nil {
+		log.Printf("could not notify parent: %v", err)
+	}
+	s.ready.Close()
+	s.ready = nil
+}
+
+// closeUnused closes the inherited sockets that no server claimed.
+func (s *activatedSockets) closeUnused() {
+	for _, listeners := range s.listeners {
+		for _, l := range listeners {
+			log.Printf("closing unused inherited listener on %s", l.Addr())
+			l.Close()
+		}
+	}
+	for _, packetConns := range s.packetConns {
+		for _, pc := range packetConns {
+			log.Printf("closing unused inherited socket on %s", pc.LocalAddr())
+			pc.Close()
+		}
+	}
+	s.listeners = make(map[int][]net.Listener)
+	s.packetConns = make(map[int][]net.PacketConn)
+}
+
+// controlSocket runs a net.ListenConfig Control function against a socket
+// that was created elsewhere, so that inherited sockets get the same options
+// as the ones we bind ourselves.
+func controlSocket(c syscall.Conn, addr net.Addr, control func(network, address string, conn syscall.RawConn) error) error {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	network := addr.Network()
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+			network += "4"
+		} else {
+			network += "6"
+		}
+	}
+
+	return control(network, addr.String(), rawConn)
+}
+
+func addrPort(addr net.Addr) (int, error) {
+	_, portString, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(portString)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"runtime"
+	"strconv"
+	"testing"
+)
+
+func TestListenFdNames(t *testing.T) {
+	tests := []struct {
+		nfds    int
+		fdnames string
+		want    []string
+	}{
+		{1, "", []string{"fd3"}},
+		{2, "", []string{"fd3", "fd4"}},
+		{2, "https:http3", []string{"https", "http3"}},
+		{3, "https", []string{"https", "fd4", "fd5"}},
+		{3, "https::admin", []string{"https", "fd4", "admin"}},
+		{1, "https:http3", []string{"https"}},
+	}
+	for _, test := range tests {
+		if got := listenFdNames(test.nfds, test.fdnames); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("listenFdNames(%d, %q) = %q, want %q", test.nfds, test.fdnames, got, test.want)
+		}
+	}
+}
+
+func TestActivatedSocketsFromEnvNotActivated(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name              string
+		listenPID         string
+		listenFDs         string
+		upgradeParentPPID string
+	}{
+		{"no environment", "", "", ""},
+		{"other process", "1", "2", ""},
+		{"invalid pid", "self", "2", ""},
+		{"other parent", "", "2", "1"},
+		{"no descriptors", pid, "0", ""},
+		{"invalid count", pid, "two", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LISTEN_PID", test.listenPID)
+			t.Setenv("LISTEN_FDS", test.listenFDs)
+			t.Setenv(upgradeParentEnv, test.upgradeParentPPID)
+
+			s, err := activatedSocketsFromEnv()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(s.listeners) != 0 || len(s.packetConns) != 0 || s.ready != nil {
+				t.Errorf("got sockets %v, %v, %v; want none", s.listeners, s.packetConns, s.ready)
+			}
+			select {
+			case <-s.released:
+			default:
+				t.Error("UDP sockets not released")
+			}
+		})
+	}
+}
+
+func TestActivatedSocketsAdd(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sockets can't be turned into files on Windows")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tcpFile, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpFile, err := pc.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &activatedSockets{
+		listeners:   make(map[int][]net.Listener),
+		packetConns: make(map[int][]net.PacketConn),
+	}
+	tests := []struct {
+		name string
+		f    *os.File
+		err  error
+	}{
+		{"TCP listener", tcpFile, nil},
+		{"UDP socket", udpFile, nil},
+		{"pipe", r, errUnsupportedSocket},
+	}
+	for _, test := range tests {
+		if err := s.add(test.f); !errors.Is(err, test.err) {
+			t.Errorf("add(%s) = %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	tcpPort := l.Addr().(*net.TCPAddr).Port
+	if got := s.listener(tcpPort); got == nil {
+		t.Errorf("no listener on port %d", tcpPort)
+	} else {
+		got.Close()
+	}
+	udpPort := pc.LocalAddr().(*net.UDPAddr).Port
+	if got := s.packetConn(udpPort); got == nil {
+		t.Errorf("no UDP socket on port %d", udpPort)
+	} else {
+		got.Close()
+	}
+}
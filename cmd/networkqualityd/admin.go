@@ -0,0 +1,400 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+// defaultAdminAddr is the admin address used by -debug without -admin-addr.
+const defaultAdminAddr = "127.0.0.1:9090"
+
+// secretFlags are not shown in the admin config dump.
+var secretFlags = map[string]bool{
+	"admin-token":     true,
+	"dns-update-tsig": true,
+}
+
+// An adminServer serves the operational endpoints (profiling, metrics,
+// health checks and control actions) on a listener of their own, away from
+// the measurement ports.
+type adminServer struct {
+	ctx        context.Context
+	token      string
+	conns      *connTracker
+	certs      *certStore
+	h3Requests *int64
+
+	// statsInterval is how often debug stats are logged.
+	statsInterval time.Duration
+
+	// results are the results submitted by clients, if they may be.
+	results *nqserver.ResultStore
+
+	// sessions are the measurement sessions, if they are tracked.
+	sessions *nqserver.SessionTracker
+
+	// udpEcho is the UDP echo service, if it runs.
+	udpEcho *nqserver.UDPEchoServer
+
+	// Readiness fails beyond these saturation thresholds, if set.
+	maxBulkStreams int64
+	maxSendRate    uint64
+
+	ready       atomic.Bool
+	draining    atomic.Bool
+	listeners   atomic.Int64
+	serving     atomic.Int64
+	bulkStreams atomic.Int64
+	sendRate    atomic.Uint64
+
+	mut         sync.Mutex
+	servers     []*nqserver.Server
+	statsCancel context.CancelFunc
+}
+
+// newAdminServer returns an admin server for the measurement servers added
+// with addServer. token is the bearer token required to use it, or @file to
+// read it from a file; it may be empty. Debug stats are logged until ctx is
+// done.
+func newAdminServer(ctx context.Context, token string, conns *connTracker, certs *certStore, h3Requests *int64) (*adminServer, error) {
+	if strings.HasPrefix(token, "@") {
+		b, err := os.ReadFile(token[1:])
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	}
+
+	return &adminServer{
+		ctx:        ctx,
+		token:      token,
+		conns:      conns,
+		certs:      certs,
+		h3Requests: h3Requests,
+	}, nil
+}
+
+// addServer adds m to the servers reported on.
+func (a *adminServer) addServer(m *nqserver.Server) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	a.servers = append(a.servers, m)
+}
+
+func (a *adminServer) measurementServers() []*nqserver.Server {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+	return append([]*nqserver.Server(nil), a.servers...)
+}
+
+// setDraining enables or disables drain mode, in which we report that we
+// aren't ready and turn away new tests; see admit.
+func (a *adminServer) setDraining(draining bool) {
+	if a.draining.Swap(draining) == draining {
+		return
+	}
+	if draining {
+		log.Printf("draining")
+	} else {
+		log.Printf("resuming")
+	}
+}
+
+// setDebugStats starts or stops logging the throughput of the servers.
+func (a *adminServer) setDebugStats(enable bool) {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	if !enable {
+		if a.statsCancel != nil {
+			a.statsCancel()
+			a.statsCancel = nil
+		}
+		return
+	}
+	if a.statsCancel != nil {
+		return
+	}
+
+	var ctx context.Context
+	ctx, a.statsCancel = context.WithCancel(a.ctx)
+	go nqserver.NewStatsReporter(a.servers, a.statsInterval, nqserver.LogStatsSink{}).Run(ctx)
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	mux.HandleFunc("/healthz", a.healthzHandler)
+	mux.HandleFunc("/readyz", a.readyzHandler)
+	mux.HandleFunc("/metrics", a.metricsHandler)
+	mux.HandleFunc("/connections", a.connectionsHandler)
+	if a.results != nil {
+		mux.HandleFunc("/results", a.results.QueryHandler)
+	}
+	if a.sessions != nil {
+		mux.HandleFunc("/sessions", a.sessions.QueryHandler)
+	}
+	mux.HandleFunc("/connections/close", a.post(func(r *http.Request) error {
+		id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("id must be a connection id")
+		}
+		return a.conns.closeConn(id)
+	}))
+	mux.HandleFunc("/config", a.configHandler)
+
+	mux.HandleFunc("/drain", a.post(func(r *http.Request) error {
+		a.setDraining(true)
+		return nil
+	}))
+	mux.HandleFunc("/resume", a.post(func(r *http.Request) error {
+		a.setDraining(false)
+		return nil
+	}))
+	mux.HandleFunc("/reload-certs", a.post(func(r *http.Request) error {
+		if a.certs == nil {
+			return fmt.Errorf("not serving TLS")
+		}
+		if err := a.certs.reload(); err != nil {
+			return err
+		}
+		log.Printf("reloaded %s", a.certs.certFile)
+		return nil
+	}))
+	mux.HandleFunc("/debug-stats", a.post(func(r *http.Request) error {
+		enable, err := strconv.ParseBool(r.URL.Query().Get("enable"))
+		if err != nil {
+			return fmt.Errorf("enable must be true or false")
+		}
+		a.setDebugStats(enable)
+		return nil
+	}))
+
+	return a.authorize(mux)
+}
+
+// authorize requires the bearer token, if any, for everything but the
+// health checks, which load balancers must be able to reach.
+func (a *adminServer) authorize(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(a.token) > 0 && r.URL.Path != "/healthz" && r.URL.Path != "/readyz" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="networkqualityd"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// post returns a handler running action for POST requests and replying
+// with the resulting status.
+func (a *adminServer) post(action func(*http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		a.mut.Lock()
+		debugStats := a.statsCancel != nil
+		a.mut.Unlock()
+		ready, _ := a.readiness()
+		writeJSON(w, map[string]bool{
+			"ready":       ready,
+			"draining":    a.draining.Load(),
+			"debug_stats": debugStats,
+		})
+	}
+}
+
+func (a *adminServer) healthzHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// readyzHandler reports whether all listeners are serving, and we are
+// neither draining nor saturated.
+func (a *adminServer) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, reason := a.readiness()
+	if !ready {
+		http.Error(w, reason, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, reason)
+}
+
+func (a *adminServer) connectionsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.conns.list())
+}
+
+// configHandler dumps the command line flags, leaving out secrets.
+func (a *adminServer) configHandler(w http.ResponseWriter, r *http.Request) {
+	flags := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if secretFlags[f.Name] && len(value) > 0 {
+			value = "REDACTED"
+		}
+		flags[f.Name] = value
+	})
+	writeJSON(w, map[string]interface{}{
+		"version": nqserver.GitVersion,
+		"flags":   flags,
+	})
+}
+
+// metricsHandler writes the server counters in the Prometheus text format.
+func (a *adminServer) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	servers := a.measurementServers()
+	counters := []struct {
+		name, help string
+		value      func(*nqserver.Server) uint64
+	}{
+		{"networkqualityd_bytes_served_total", "Bytes sent by the measurement handlers.", func(m *nqserver.Server) uint64 { return atomic.LoadUint64(&m.BytesServed) }},
+		{"networkqualityd_bytes_received_total", "Bytes received by the measurement handlers.", func(m *nqserver.Server) uint64 { return atomic.LoadUint64(&m.BytesReceived) }},
+		{"networkqualityd_connections_total", "Connections accepted.", func(m *nqserver.Server) uint64 { return atomic.LoadUint64(&m.Connections) }},
+		{"networkqualityd_mptcp_connections_total", "Connections that negotiated Multipath TCP.", func(m *nqserver.Server) uint64 { return atomic.LoadUint64(&m.MPTCPConnections) }},
+		{"networkqualityd_ecn_connections_total", "Connections that negotiated ECN.", func(m *nqserver.Server) uint64 { return atomic.LoadUint64(&m.ECNConnections) }},
+		{"networkqualityd_ce_marks_total", "CE marked packets reported by peers.", func(m *nqserver.Server) uint64 { return atomic.LoadUint64(&m.CEMarks) }},
+	}
+	for _, c := range counters {
+		writeMetricHeader(w, c.name, "counter", c.help)
+		for _, m := range servers {
+			fmt.Fprintf(w, "%s{port=\"%d\",scheme=\"%s\"} %d\n", c.name, m.PublicPort, m.Scheme, c.value(m))
+		}
+	}
+
+	writeMetricHeader(w, "networkqualityd_open_connections", "gauge", "Open measurement connections by state.")
+	for _, m := range servers {
+		counts := a.conns.count(m.PublicPort)
+		states := make([]string, 0, len(counts))
+		for state := range counts {
+			states = append(states, state)
+		}
+		sort.Strings(states)
+		for _, state := range states {
+			fmt.Fprintf(w, "networkqualityd_open_connections{port=\"%d\",scheme=\"%s\",state=\"%s\"} %d\n", m.PublicPort, m.Scheme, state, counts[state])
+		}
+	}
+
+	if a.udpEcho != nil {
+		writeMetricHeader(w, "networkqualityd_udp_echo_packets_total", "counter", "UDP echo packets by outcome.")
+		fmt.Fprintf(w, "networkqualityd_udp_echo_packets_total{result=\"reflected\"} %d\n", atomic.LoadUint64(&a.udpEcho.PacketsReflected))
+		fmt.Fprintf(w, "networkqualityd_udp_echo_packets_total{result=\"rate_limited\"} %d\n", atomic.LoadUint64(&a.udpEcho.PacketsRateLimited))
+		fmt.Fprintf(w, "networkqualityd_udp_echo_packets_total{result=\"malformed\"} %d\n", atomic.LoadUint64(&a.udpEcho.PacketsMalformed))
+	}
+
+	writeMetricHeader(w, "networkqualityd_h3_requests_in_flight", "gauge", "HTTP/3 requests being served.")
+	fmt.Fprintf(w, "networkqualityd_h3_requests_in_flight %d\n", atomic.LoadInt64(a.h3Requests))
+
+	writeMetricHeader(w, "networkqualityd_bulk_transfers_in_flight", "gauge", "Bulk transfers (/large and /slurp) being served over any protocol.")
+	fmt.Fprintf(w, "networkqualityd_bulk_transfers_in_flight %d\n", a.bulkStreams.Load())
+
+	writeMetricHeader(w, "networkqualityd_send_rate_bytes", "gauge", "Bytes per second sent by the measurement handlers over the last second.")
+	fmt.Fprintf(w, "networkqualityd_send_rate_bytes %d\n", a.sendRate.Load())
+
+	writeMetricHeader(w, "networkqualityd_listeners_serving", "gauge", "Measurement listeners being served.")
+	fmt.Fprintf(w, "networkqualityd_listeners_serving %d\n", a.serving.Load())
+
+	ready, _ := a.readiness()
+	writeMetricHeader(w, "networkqualityd_ready", "gauge", "Whether the server is ready, i.e. serving and neither draining nor saturated.")
+	fmt.Fprintf(w, "networkqualityd_ready %d\n", boolMetric(ready))
+
+	writeMetricHeader(w, "networkqualityd_draining", "gauge", "Whether the server is in drain mode.")
+	fmt.Fprintf(w, "networkqualityd_draining %d\n", boolMetric(a.draining.Load()))
+
+	writeMetricHeader(w, "networkqualityd_goroutines", "gauge", "Goroutines that currently exist.")
+	fmt.Fprintf(w, "networkqualityd_goroutines %d\n", runtime.NumGoroutine())
+
+	writeMetricHeader(w, "networkqualityd_build_info", "gauge", "The version of networkqualityd.")
+	fmt.Fprintf(w, "networkqualityd_build_info{version=%q} 1\n", nqserver.GitVersion)
+}
+
+func writeMetricHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(v); err != nil {
+		log.Printf("could not write admin response: %v", err)
+	}
+}
+
+// listenAdmin returns the listener for the admin interface at address,
+// which may have been inherited.
+// isLoopbackAddr reports whether address (host:port) can only be reached
+// from this machine.
+func isLoopbackAddr(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+func listenAdmin(ctx context.Context, activated *activatedSockets, address string) (net.Listener, error) {
+	_, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portString)
+	}
+
+	if nl := activated.listener(port); nl != nil {
+		log.Printf("Using inherited listener on %s", nl.Addr())
+		return nl, nil
+	}
+	var lc net.ListenConfig
+	return lc.Listen(ctx, "tcp", address)
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import "testing"
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		address string
+		want    bool
+	}{
+		{"127.0.0.1:9090", true},
+		{"127.1.2.3:9090", true},
+		{"[::1]:9090", true},
+		{"localhost:9090", true},
+		{"0.0.0.0:9090", false},
+		{"[::]:9090", false},
+		{":9090", false},
+		{"192.0.2.1:9090", false},
+		{"admin.example.com:9090", false},
+		{"127.0.0.1", false},
+	}
+	for _, test := range tests {
+		if got := isLoopbackAddr(test.address); got != test.want {
+			t.Errorf("isLoopbackAddr(%q) = %t, want %t", test.address, got, test.want)
+		}
+	}
+}
@@ -3,14 +3,24 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
+	"os"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/brutella/dnssd"
 	"github.com/network-quality/goserver"
 )
 
+// announceInterfacePollInterval is how often the announcer checks whether
+// the addresses it announces have changed.
+const announceInterfacePollInterval = 10 * time.Second
+
 func getNetInterfaces() []net.Interface {
 	if interfaceList, interfaceListErr := net.Interfaces(); interfaceListErr == nil {
 		return interfaceList
@@ -31,8 +41,155 @@ func getInterfaceIPs(iface net.Interface) []net.IP {
 	return nil
 }
 
-func configureAnnouncer(ips []net.IP, hostName string, port int) (dnssd.Responder, dnssd.ServiceHandle, error) {
-	log.Printf("announcing %s %s", hostName, goserver.ServiceType)
+// An announcement is a measurement listener to announce as a service
+// instance of type goserver.ServiceType.
+type announcement struct {
+	name     string
+	port     int
+	text     map[string]string
+	subtypes []string
+}
+
+// instanceName returns the full name of the service instance in domain
+// (e.g. "local."), as used in PTR records.
+func (a announcement) instanceName(domain string) string {
+	// Dots in instance names are escaped (RFC 6763 4.3).
+	return fmt.Sprintf("%s.%s.%s", strings.ReplaceAll(a.name, ".", "\\."), goserver.ServiceType, domain)
+}
+
+// serviceName returns the name browsed for to find instances in domain.
+func serviceName(domain string) string {
+	return fmt.Sprintf("%s.%s", goserver.ServiceType, domain)
+}
+
+// subtypeName returns the name browsed for to find instances of subtype in
+// domain.
+func subtypeName(subtype, domain string) string {
+	return fmt.Sprintf("%s._sub.%s.%s", subtype, goserver.ServiceType, domain)
+}
+
+// protocolSubtypes returns the subtypes announcing protocols, e.g. _h2c for
+// "h2c" and _http1 for "http/1.1".
+func protocolSubtypes(protocols []string) []string {
+	var subtypes []string
+	for _, protocol := range protocols {
+		subtype := strings.ReplaceAll(strings.TrimSuffix(protocol, ".1"), "/", "")
+		subtypes = append(subtypes, "_"+subtype)
+	}
+	return subtypes
+}
+
+// mdnsHostName returns the host to name in the SRV records of
+// announcements for name, which dnssd announces in .local. Only names in
+// .local can be claimed over multicast DNS; for any other name we use the
+// machine's.
+func mdnsHostName(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	if strings.HasSuffix(strings.ToLower(name), ".local") {
+		return name[:len(name)-len(".local")]
+	}
+	return localHostName()
+}
+
+// localHostName returns the first label of the machine's host name, as
+// dnssd would use it.
+func localHostName() string {
+	hostName, err := os.Hostname()
+	if err != nil || len(hostName) == 0 {
+		return "networkquality"
+	}
+	hostName, _, _ = strings.Cut(hostName, ".")
+	return strings.ReplaceAll(hostName, " ", "-")
+}
+
+// An announcer announces measurement listeners over multicast DNS-SD on the
+// interfaces that have the addresses we listen on, and announces them again
+// when those addresses change.
+type announcer struct {
+	listenAddr string
+	host       string
+	responder  dnssd.Responder
+	subtypes   *subtypeResponder
+
+	mut           sync.Mutex
+	announcements []announcement
+	handles       []dnssd.ServiceHandle
+	addresses     string
+}
+
+func newAnnouncer(listenAddr, hostName string) (*announcer, error) {
+	responder, err := dnssd.NewResponder()
+	if err != nil {
+		return nil, err
+	}
+
+	return &announcer{
+		listenAddr: listenAddr,
+		host:       mdnsHostName(hostName),
+		responder:  responder,
+		subtypes:   &subtypeResponder{},
+	}, nil
+}
+
+// add announces a. It may be called before or after run.
+func (a *announcer) add(ann announcement) error {
+	ips, interfaces := a.currentAddresses()
+
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	log.Printf("announcing %q %s on port %d, subtypes %s", ann.name, goserver.ServiceType, ann.port, strings.Join(ann.subtypes, ","))
+
+	handle, err := a.addService(ann, ips, interfaces)
+	if err != nil {
+		return err
+	}
+
+	a.announcements = append(a.announcements, ann)
+	a.handles = append(a.handles, handle)
+	a.subtypes.set(a.announcements, interfaces)
+	return nil
+}
+
+func (a *announcer) addService(ann announcement, ips []net.IP, interfaces []string) (dnssd.ServiceHandle, error) {
+	service, err := dnssd.NewService(dnssd.Config{
+		Name:   ann.name,
+		Type:   goserver.ServiceType,
+		Host:   a.host,
+		Text:   ann.text,
+		IPs:    ips,
+		Ifaces: interfaces,
+		Port:   ann.port,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a.responder.Add(service)
+}
+
+// currentAddresses returns the addresses to announce and the interfaces
+// they are on. Both are nil when listening on all addresses, which has
+// dnssd announce each interface's own addresses.
+func (a *announcer) currentAddresses() ([]net.IP, []string) {
+	// The user may give us a hostname (rather than an address to listen on). In order to
+	// handle this situation, we will use DNS to convert it to an IP. As a result, we may
+	// get back more than one address -- handle that!
+	var ips []net.IP
+	if len(a.listenAddr) > 0 {
+		if addresses, lookupErr := net.LookupHost(a.listenAddr); lookupErr == nil {
+			for _, addr := range addresses {
+				if parsedAddr := net.ParseIP(addr); parsedAddr != nil {
+					if parsedAddr.IsUnspecified() {
+						return nil, nil
+					}
+					ips = append(ips, parsedAddr)
+				}
+			}
+		}
+	} else {
+		return nil, nil
+	}
+
 	// We only want to advertise on the interfaces that go with the addresses!
 	interfaces := make([]string, 0)
 
@@ -55,33 +212,112 @@ InterfacesLoop:
 		}
 	}
 
-	nameParts := strings.Split(hostName, ".")
-	if len(nameParts) > 0 {
-		hostName = nameParts[0]
+	return ips, interfaces
+}
+
+// addressesKey summarizes the addresses of the interfaces we announce on,
+// as returned by currentAddresses, so that changes can be noticed.
+func addressesKey(ips []net.IP, interfaces []string) string {
+	var keys []string
+	for _, iface := range getNetInterfaces() {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+		if interfaces != nil && !contains(interfaces, iface.Name) {
+			continue
+		}
+		for _, ip := range getInterfaceIPs(iface) {
+			keys = append(keys, iface.Name+"/"+ip.String())
+		}
 	}
-	cfg := dnssd.Config{
-		Name:   hostName,
-		Type:   goserver.ServiceType,
-		Host:   hostName,
-		IPs:    ips,
-		Ifaces: interfaces,
-		Port:   port,
+	for _, ip := range ips {
+		keys = append(keys, ip.String())
 	}
 
-	dnsService, err := dnssd.NewService(cfg)
-	if err != nil {
-		return nil, nil, err
+	sort.Strings(keys)
+	return strings.Join(keys, " ")
+}
+
+// run responds to queries until ctx is done.
+func (a *announcer) run(ctx context.Context) error {
+	addresses := addressesKey(a.currentAddresses())
+	a.mut.Lock()
+	a.addresses = addresses
+	a.mut.Unlock()
+
+	go a.watchAddresses(ctx)
+
+	go func() {
+		if err := a.subtypes.run(ctx); err != nil {
+			log.Printf("could not answer DNS-SD subtype queries: %v", err)
+		}
+	}()
+
+	return a.responder.Respond(ctx)
+}
+
+func (a *announcer) watchAddresses(ctx context.Context) {
+	ticker := time.NewTicker(announceInterfacePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// Looking up the listen address may take a while, so it is done
+		// without holding a.mut.
+		ips, interfaces := a.currentAddresses()
+		addresses := addressesKey(ips, interfaces)
+
+		a.mut.Lock()
+		if addresses != a.addresses {
+			log.Printf("interface addresses changed, announcing again")
+			a.addresses = addresses
+			a.reannounce(ips, interfaces)
+		}
+		a.mut.Unlock()
+	}
+}
+
+// reannounce replaces the announced services with ones for the given
+// addresses. a.mut must be held.
+func (a *announcer) reannounce(ips []net.IP, interfaces []string) {
+	for _, handle := range a.handles {
+		a.responder.Remove(handle)
 	}
+	a.handles = nil
 
-	dnsResponder, err := dnssd.NewResponder()
-	if err != nil {
-		return nil, nil, err
+	for _, ann := range a.announcements {
+		handle, err := a.addService(ann, ips, interfaces)
+		if err != nil {
+			log.Printf("could not announce %q: %v", ann.name, err)
+			continue
+		}
+		a.handles = append(a.handles, handle)
 	}
+	a.subtypes.set(a.announcements, interfaces)
+}
 
-	dnsServiceHandle, err := dnsResponder.Add(dnsService)
-	if err != nil {
-		return nil, nil, err
+// remove withdraws all announcements.
+func (a *announcer) remove() {
+	a.mut.Lock()
+	defer a.mut.Unlock()
+
+	a.subtypes.goodbye()
+	for _, handle := range a.handles {
+		a.responder.Remove(handle)
 	}
+	a.handles = nil
+}
 
-	return dnsResponder, dnsServiceHandle, nil
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
 }
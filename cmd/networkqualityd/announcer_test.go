@@ -0,0 +1,70 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProtocolSubtypes(t *testing.T) {
+	tests := []struct {
+		protocols []string
+		want      []string
+	}{
+		{nil, nil},
+		{[]string{"h2"}, []string{"_h2"}},
+		{[]string{"http/1.1", "h2c"}, []string{"_http1", "_h2c"}},
+		{[]string{"http/1.1", "h2", "h3"}, []string{"_http1", "_h2", "_h3"}},
+	}
+	for _, test := range tests {
+		if got := protocolSubtypes(test.protocols); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("protocolSubtypes(%q) = %q, want %q", test.protocols, got, test.want)
+		}
+	}
+}
+
+func TestAnnouncementNames(t *testing.T) {
+	tests := []struct {
+		name     string
+		domain   string
+		instance string
+		subtype  string
+	}{
+		{"networkquality", "local.", "networkquality._nq._tcp.local.", "_h2._sub._nq._tcp.local."},
+		{"nq.example.com", "local.", `nq\.example\.com._nq._tcp.local.`, "_h2._sub._nq._tcp.local."},
+		{"networkquality", "example.com.", "networkquality._nq._tcp.example.com.", "_h2._sub._nq._tcp.example.com."},
+	}
+	for _, test := range tests {
+		ann := announcement{name: test.name}
+		if got := ann.instanceName(test.domain); got != test.instance {
+			t.Errorf("instanceName(%q) of %q = %q, want %q", test.domain, test.name, got, test.instance)
+		}
+		if got := subtypeName("_h2", test.domain); got != test.subtype {
+			t.Errorf("subtypeName(%q, %q) = %q, want %q", "_h2", test.domain, got, test.subtype)
+		}
+	}
+}
+
+func TestMDNSHostName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"server.local", "server"},
+		{"server.local.", "server"},
+		{"Server.LOCAL", "Server"},
+		{"networkquality.example.com", localHostName()},
+		{"local", localHostName()},
+	}
+	for _, test := range tests {
+		if got := mdnsHostName(test.name); got != test.want {
+			t.Errorf("mdnsHostName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+
+	if host := localHostName(); len(host) == 0 || strings.ContainsAny(host, ". ") {
+		t.Errorf("localHostName() = %q, want a single label", host)
+	}
+}
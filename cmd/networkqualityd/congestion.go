@@ -0,0 +1,46 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// congestionControlPort is a port serving measurements with a particular
+// TCP congestion control algorithm.
+type congestionControlPort struct {
+	algorithm string
+	port      int
+}
+
+// parseCongestionControlPorts parses -congestion-control-ports, a comma
+// separated list of algorithm=port pairs.
+func parseCongestionControlPorts(value string) ([]congestionControlPort, error) {
+	var result []congestionControlPort
+	if len(value) == 0 {
+		return result, nil
+	}
+
+	ports := make(map[int]bool)
+	for _, pair := range strings.Split(value, ",") {
+		algorithm, portString, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || len(algorithm) == 0 {
+			return nil, fmt.Errorf("-congestion-control-ports: %q is not algorithm=port", pair)
+		}
+
+		port, err := strconv.Atoi(portString)
+		if err != nil || port <= 0 || port > 65535 {
+			return nil, fmt.Errorf("-congestion-control-ports: invalid port %q for %s", portString, algorithm)
+		}
+		if ports[port] {
+			return nil, fmt.Errorf("-congestion-control-ports: port %d is used more than once", port)
+		}
+		ports[port] = true
+
+		result = append(result, congestionControlPort{algorithm: algorithm, port: port})
+	}
+
+	return result, nil
+}
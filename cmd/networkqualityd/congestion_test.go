@@ -0,0 +1,38 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseCongestionControlPorts(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []congestionControlPort
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "cubic=4044", want: []congestionControlPort{{"cubic", 4044}}},
+		{value: "cubic=4044, bbr=4045", want: []congestionControlPort{{"cubic", 4044}, {"bbr", 4045}}},
+		{value: "cubic", wantErr: true},
+		{value: "=4044", wantErr: true},
+		{value: "cubic=", wantErr: true},
+		{value: "cubic=http", wantErr: true},
+		{value: "cubic=0", wantErr: true},
+		{value: "cubic=65536", wantErr: true},
+		{value: "cubic=4044,bbr=4044", wantErr: true},
+		{value: "cubic=4044,", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseCongestionControlPorts(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseCongestionControlPorts(%q) error = %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseCongestionControlPorts(%q) = %v, want %v", test.value, got, test.want)
+		}
+	}
+}
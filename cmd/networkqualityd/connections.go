@@ -0,0 +1,495 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	nqserver "github.com/network-quality/goserver"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/logging"
+)
+
+// connSampleInterval is how often the throughput of each connection is
+// measured.
+const connSampleInterval = time.Second
+
+// byteCounters count the bytes a connection sent and received, including
+// TLS or QUIC overhead.
+type byteCounters struct {
+	sent     atomic.Uint64
+	received atomic.Uint64
+}
+
+// A trackedConn is a connection to one of the measurement servers. Its
+// mutable fields are guarded by the connTracker's mutex.
+type trackedConn struct {
+	id       uint64
+	port     int
+	scheme   string
+	remote   string
+	local    string
+	since    time.Time
+	counters *byteCounters
+	close    func() error
+
+	state    string
+	protocol string
+	tls      *tls.ConnectionState
+	handlers map[string]int
+
+	lastSent, lastReceived uint64
+	sendRate, receiveRate  float64
+}
+
+// connInfo is how the admin interface lists a trackedConn.
+type connInfo struct {
+	ID            uint64    `json:"id"`
+	RemoteAddr    string    `json:"remote_addr"`
+	LocalAddr     string    `json:"local_addr"`
+	Port          int       `json:"port"`
+	Scheme        string    `json:"scheme"`
+	Protocol      string    `json:"protocol"`
+	TLSVersion    string    `json:"tls_version,omitempty"`
+	ALPN          string    `json:"alpn,omitempty"`
+	State         string    `json:"state"`
+	Handlers      []string  `json:"handlers"`
+	BytesSent     uint64    `json:"bytes_sent"`
+	BytesReceived uint64    `json:"bytes_received"`
+	SendRate      float64   `json:"send_bps"`
+	ReceiveRate   float64   `json:"receive_bps"`
+	Since         time.Time `json:"since"`
+	Age           float64   `json:"age_seconds"`
+}
+
+type trackedConnKey struct{}
+
+// h3ConnKey identifies a QUIC connection to a port for the HTTP/3 requests
+// made on it.
+type h3ConnKey struct {
+	port   int
+	remote string
+}
+
+// A connTracker keeps track of the open measurement connections: TCP ones
+// from the listeners wrapped by listener, and QUIC ones from those wrapped
+// by quicListener. http.Server ConnContext and ConnState hooks and a
+// request handler wrapper fill in what they are being used for.
+type connTracker struct {
+	mut    sync.Mutex
+	nextID uint64
+	conns  map[uint64]*trackedConn
+
+	// h3Conns holds the QUIC connections, whose HTTP/3 requests can only
+	// be told apart by their address.
+	h3Conns map[h3ConnKey]*trackedConn
+
+	// quicCounters holds the counters of QUIC connections by tracing ID
+	// until they are accepted.
+	quicCounters map[uint64]*byteCounters
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{
+		conns:        make(map[uint64]*trackedConn),
+		h3Conns:      make(map[h3ConnKey]*trackedConn),
+		quicCounters: make(map[uint64]*byteCounters),
+	}
+}
+
+func (t *connTracker) add(tc *trackedConn) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	t.nextID++
+	tc.id = t.nextID
+	tc.since = time.Now()
+	tc.handlers = make(map[string]int)
+	t.conns[tc.id] = tc
+	if tc.protocol == "h3" {
+		t.h3Conns[h3ConnKey{tc.port, tc.remote}] = tc
+	}
+}
+
+func (t *connTracker) remove(tc *trackedConn) {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	delete(t.conns, tc.id)
+	// A new connection from the same address may have taken its place.
+	key := h3ConnKey{tc.port, tc.remote}
+	if t.h3Conns[key] == tc {
+		delete(t.h3Conns, key)
+	}
+}
+
+// listener returns a listener counting the bytes of the connections
+// accepted from nl by the server for port.
+func (t *connTracker) listener(nl net.Listener, port int, scheme string) net.Listener {
+	return &trackingListener{Listener: nl, t: t, port: port, scheme: scheme}
+}
+
+type trackingListener struct {
+	net.Listener
+	t      *connTracker
+	port   int
+	scheme string
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	cc := &countingConn{Conn: c, counters: &byteCounters{}}
+	cc.tc = &trackedConn{
+		port:     l.port,
+		scheme:   l.scheme,
+		remote:   c.RemoteAddr().String(),
+		local:    c.LocalAddr().String(),
+		counters: cc.counters,
+		close:    c.Close,
+		state:    "new",
+	}
+	l.t.add(cc.tc)
+	cc.t = l.t
+	return cc, nil
+}
+
+// countingConn counts the bytes read and written, and stops tracking the
+// connection once it is closed.
+type countingConn struct {
+	net.Conn
+	t        *connTracker
+	tc       *trackedConn
+	counters *byteCounters
+	once     sync.Once
+}
+
+// NetConn returns the underlying connection, like tls.Conn does.
+func (c *countingConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.counters.received.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.counters.sent.Add(uint64(n))
+	return n, err
+}
+
+func (c *countingConn) Close() error {
+	c.once.Do(func() { c.t.remove(c.tc) })
+	return c.Conn.Close()
+}
+
+// trackedTCPConn returns the tracked connection c wraps, if any.
+func trackedTCPConn(c net.Conn) *trackedConn {
+	for {
+		switch conn := c.(type) {
+		case *countingConn:
+			return conn.tc
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// connContext is a http.Server ConnContext function making the tracked
+// connection available to handler.
+func (t *connTracker) connContext(ctx context.Context, c net.Conn) context.Context {
+	if tc := trackedTCPConn(c); tc != nil {
+		return context.WithValue(ctx, trackedConnKey{}, tc)
+	}
+	return ctx
+}
+
+// connState is a http.Server ConnState function.
+func (t *connTracker) connState(c net.Conn, state http.ConnState) {
+	tc := trackedTCPConn(c)
+	if tc == nil {
+		return
+	}
+
+	// The handshake is done by the time the first request is read, and
+	// reading the state then doesn't wait for it.
+	var tlsState *tls.ConnectionState
+	if tlsConn, ok := c.(*tls.Conn); ok && state == http.StateActive {
+		cs := tlsConn.ConnectionState()
+		tlsState = &cs
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	tc.state = state.String()
+	if tlsState != nil && tc.tls == nil {
+		tc.tls = tlsState
+	}
+	// Besides WebSockets, only h2c takes over connections from the
+	// HTTP/1.1 server.
+	if state == http.StateHijacked {
+		tc.state = "active"
+		if tc.protocol != "websocket" {
+			tc.protocol = "h2c"
+		}
+	}
+}
+
+// quicTracer is a quic.Config Tracer counting the bytes of each QUIC
+// connection.
+func (t *connTracker) quicTracer(ctx context.Context, _ logging.Perspective, _ quic.ConnectionID) *logging.ConnectionTracer {
+	id, ok := ctx.Value(quic.ConnectionTracingKey).(uint64)
+	if !ok {
+		return nil
+	}
+
+	counters := &byteCounters{}
+	t.mut.Lock()
+	t.quicCounters[id] = counters
+	t.mut.Unlock()
+
+	sent := func(size logging.ByteCount) { counters.sent.Add(uint64(size)) }
+	received := func(size logging.ByteCount) { counters.received.Add(uint64(size)) }
+	return &logging.ConnectionTracer{
+		SentLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			sent(size)
+		},
+		SentShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ *logging.AckFrame, _ []logging.Frame) {
+			sent(size)
+		},
+		ReceivedLongHeaderPacket: func(_ *logging.ExtendedHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			received(size)
+		},
+		ReceivedShortHeaderPacket: func(_ *logging.ShortHeader, size logging.ByteCount, _ logging.ECN, _ []logging.Frame) {
+			received(size)
+		},
+		Close: func() {
+			t.mut.Lock()
+			delete(t.quicCounters, id)
+			t.mut.Unlock()
+		},
+	}
+}
+
+// quicListener returns a listener tracking the QUIC connections accepted
+// from ln by the HTTP/3 server for port. Their bytes are only counted if
+// the listener was created with quicTracer.
+func (t *connTracker) quicListener(ln http3.QUICEarlyListener, port int) http3.QUICEarlyListener {
+	return &trackingQUICListener{QUICEarlyListener: ln, t: t, port: port}
+}
+
+type trackingQUICListener struct {
+	http3.QUICEarlyListener
+	t    *connTracker
+	port int
+}
+
+func (l *trackingQUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	c, err := l.QUICEarlyListener.Accept(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counters := &byteCounters{}
+	if id, ok := c.Context().Value(quic.ConnectionTracingKey).(uint64); ok {
+		l.t.mut.Lock()
+		if qc, ok := l.t.quicCounters[id]; ok {
+			counters = qc
+		}
+		l.t.mut.Unlock()
+	}
+
+	tc := &trackedConn{
+		port:     l.port,
+		scheme:   "https",
+		remote:   c.RemoteAddr().String(),
+		local:    c.LocalAddr().String(),
+		counters: counters,
+		close: func() error {
+			return c.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "closed by administrator")
+		},
+		state:    "new",
+		protocol: "h3",
+	}
+	l.t.add(tc)
+
+	go func() {
+		select {
+		case <-c.HandshakeComplete():
+			cs := c.ConnectionState().TLS
+			l.t.mut.Lock()
+			tc.tls = &cs
+			tc.state = "active"
+			if cs.NegotiatedProtocol == nqserver.NextProtoRawQUIC {
+				tc.protocol = cs.NegotiatedProtocol
+			}
+			l.t.mut.Unlock()
+		case <-c.Context().Done():
+		}
+		<-c.Context().Done()
+		l.t.remove(tc)
+	}()
+
+	return c, nil
+}
+
+// handler returns a handler recording which of the connections of the
+// server for port h is serving requests for.
+func (t *connTracker) handler(port int, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tc := t.requestConn(r, port)
+		if tc == nil {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		t.mut.Lock()
+		tc.handlers[r.URL.Path]++
+		switch {
+		case r.ProtoMajor == 1 && strings.EqualFold(r.Header.Get("Upgrade"), "websocket"):
+			tc.protocol = "websocket"
+		case r.ProtoMajor < 3:
+			tc.protocol = nqserver.ProtocolName(r)
+		}
+		t.mut.Unlock()
+
+		defer func() {
+			t.mut.Lock()
+			if tc.handlers[r.URL.Path]--; tc.handlers[r.URL.Path] == 0 {
+				delete(tc.handlers, r.URL.Path)
+			}
+			t.mut.Unlock()
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// requestConn returns the tracked connection r arrived on. HTTP/3 requests
+// are matched by address, as the QUIC connection isn't available to
+// handlers.
+func (t *connTracker) requestConn(r *http.Request, port int) *trackedConn {
+	if tc, ok := r.Context().Value(trackedConnKey{}).(*trackedConn); ok {
+		return tc
+	}
+	if r.ProtoMajor != 3 {
+		return nil
+	}
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return t.h3Conns[h3ConnKey{port, r.RemoteAddr}]
+}
+
+// run measures the throughput of each connection until ctx is done.
+func (t *connTracker) run(ctx context.Context) {
+	ticker := time.NewTicker(connSampleInterval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			elapsed := now.Sub(last).Seconds()
+			last = now
+
+			t.mut.Lock()
+			for _, tc := range t.conns {
+				sent, received := tc.counters.sent.Load(), tc.counters.received.Load()
+				tc.sendRate = float64(sent-tc.lastSent) * 8 / elapsed
+				tc.receiveRate = float64(received-tc.lastReceived) * 8 / elapsed
+				tc.lastSent, tc.lastReceived = sent, received
+			}
+			t.mut.Unlock()
+		}
+	}
+}
+
+// list returns the open connections, oldest first.
+func (t *connTracker) list() []connInfo {
+	now := time.Now()
+
+	t.mut.Lock()
+	conns := make([]connInfo, 0, len(t.conns))
+	for _, tc := range t.conns {
+		info := connInfo{
+			ID:            tc.id,
+			RemoteAddr:    tc.remote,
+			LocalAddr:     tc.local,
+			Port:          tc.port,
+			Scheme:        tc.scheme,
+			Protocol:      tc.protocol,
+			State:         tc.state,
+			Handlers:      make([]string, 0, len(tc.handlers)),
+			BytesSent:     tc.counters.sent.Load(),
+			BytesReceived: tc.counters.received.Load(),
+			SendRate:      tc.sendRate,
+			ReceiveRate:   tc.receiveRate,
+			Since:         tc.since,
+			Age:           now.Sub(tc.since).Seconds(),
+		}
+		if tc.tls != nil {
+			info.TLSVersion = tls.VersionName(tc.tls.Version)
+			info.ALPN = tc.tls.NegotiatedProtocol
+		}
+		for path := range tc.handlers {
+			info.Handlers = append(info.Handlers, path)
+		}
+		sort.Strings(info.Handlers)
+		conns = append(conns, info)
+	}
+	t.mut.Unlock()
+
+	sort.Slice(conns, func(i, j int) bool { return conns[i].ID < conns[j].ID })
+	return conns
+}
+
+// closeConn closes the connection with the given id.
+func (t *connTracker) closeConn(id uint64) error {
+	t.mut.Lock()
+	tc, ok := t.conns[id]
+	t.mut.Unlock()
+	if !ok {
+		return fmt.Errorf("no connection %d", id)
+	}
+	return tc.close()
+}
+
+// len returns the number of open connections.
+func (t *connTracker) len() int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	return len(t.conns)
+}
+
+// count returns the number of open connections of the server for port in
+// each state.
+func (t *connTracker) count(port int) map[string]int {
+	t.mut.Lock()
+	defer t.mut.Unlock()
+
+	counts := make(map[string]int)
+	for _, tc := range t.conns {
+		if tc.port == port {
+			counts[tc.state]++
+		}
+	}
+	return counts
+}
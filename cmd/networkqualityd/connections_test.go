@@ -0,0 +1,147 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerTCP(t *testing.T) {
+	const port = 4080
+	tracker := newConnTracker()
+	admin := &adminServer{conns: tracker}
+
+	served := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		http.NewResponseController(w).Flush()
+		served <- struct{}{}
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:     tracker.handler(port, h),
+		ConnContext: tracker.connContext,
+		ConnState:   tracker.connState,
+	}
+	go server.Serve(tracker.listener(ln, port, "http"))
+	defer server.Close()
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/large", ln.Addr()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	<-served
+
+	conns := tracker.list()
+	if len(conns) != 1 {
+		t.Fatalf("tracking %d connections, want 1", len(conns))
+	}
+	got := conns[0]
+	if got.Port != port || got.Scheme != "http" || got.Protocol != "h1" || got.State != "active" || !reflect.DeepEqual(got.Handlers, []string{"/large"}) {
+		t.Errorf("tracking %+v, want an active h1 connection to port %d serving /large", got, port)
+	}
+	if counts := tracker.count(port); counts["active"] != 1 {
+		t.Errorf("count(%d) = %v, want 1 active", port, counts)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		want   int
+	}{
+		{http.MethodGet, fmt.Sprintf("/connections/close?id=%d", got.ID), http.StatusMethodNotAllowed},
+		{http.MethodPost, "/connections/close?id=x", http.StatusBadRequest},
+		{http.MethodPost, fmt.Sprintf("/connections/close?id=%d", got.ID+1), http.StatusBadRequest},
+		{http.MethodPost, fmt.Sprintf("/connections/close?id=%d", got.ID), http.StatusOK},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		admin.handler().ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.want {
+			t.Errorf("%s %s = %d, want %d", test.method, test.target, w.Code, test.want)
+		}
+	}
+
+	// The response is cut short, and the connection forgotten.
+	if _, err := io.ReadAll(resp.Body); err == nil {
+		t.Error("response completed after closing its connection")
+	}
+	deadline := time.Now().Add(time.Second)
+	for tracker.len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tracker.len(); n != 0 {
+		t.Errorf("tracking %d connections after closing them, want 0", n)
+	}
+}
+
+func TestConnTrackerH3Requests(t *testing.T) {
+	tracker := newConnTracker()
+	first := &trackedConn{port: 4043, remote: "192.0.2.1:1000", protocol: "h3"}
+	other := &trackedConn{port: 4043, remote: "192.0.2.2:1000", protocol: "h3"}
+	tcp := &trackedConn{port: 4043, remote: "192.0.2.3:1000", protocol: "h2"}
+	tracker.add(first)
+	tracker.add(other)
+	tracker.add(tcp)
+
+	request := func(remote string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/small", nil)
+		r.ProtoMajor, r.RemoteAddr = 3, remote
+		return r
+	}
+	tests := []struct {
+		name   string
+		remote string
+		port   int
+		want   *trackedConn
+	}{
+		{"first", "192.0.2.1:1000", 4043, first},
+		{"other", "192.0.2.2:1000", 4043, other},
+		{"other port", "192.0.2.1:1000", 4044, nil},
+		{"other source port", "192.0.2.1:1001", 4043, nil},
+		{"TCP", "192.0.2.3:1000", 4043, nil},
+	}
+	for _, test := range tests {
+		if got := tracker.requestConn(request(test.remote), test.port); got != test.want {
+			t.Errorf("%s: requestConn() = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+
+	// A connection from the address of one going away replaces it.
+	second := &trackedConn{port: 4043, remote: "192.0.2.1:1000", protocol: "h3"}
+	tracker.add(second)
+	tracker.remove(first)
+	if got := tracker.requestConn(request("192.0.2.1:1000"), 4043); got != second {
+		t.Errorf("requestConn() = %+v after replacing the connection, want %+v", got, second)
+	}
+	tracker.remove(second)
+	if got := tracker.requestConn(request("192.0.2.1:1000"), 4043); got != nil {
+		t.Errorf("requestConn() = %+v after removing the connection, want none", got)
+	}
+
+	// Requests carrying their connection don't need the address.
+	r := request("198.51.100.1:1000")
+	r = r.WithContext(context.WithValue(r.Context(), trackedConnKey{}, tcp))
+	if got := tracker.requestConn(r, 4043); got != tcp {
+		t.Errorf("requestConn() = %+v for a request carrying its connection, want %+v", got, tcp)
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+// discoverMain implements `networkqualityd discover`, which lists the
+// servers announced on the local network.
+func discoverMain(args []string) int {
+	flags := flag.NewFlagSet("discover", flag.ExitOnError)
+	browseTimeout := flags.Duration("timeout", 3*time.Second, "how long to browse for servers")
+	fetchTimeout := flags.Duration("fetch-timeout", 5*time.Second, "how long to wait for each server's config")
+	jsonOutput := flags.Bool("json", false, "print the servers as JSON")
+	insecure := flags.Bool("insecure", false, "don't verify server certificates (e.g. when using -create-cert)")
+	_ = flags.Parse(args)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+
+	client := &http.Client{
+		Timeout: *fetchTimeout,
+		Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: *insecure},
+			ForceAttemptHTTP2: true,
+		},
+	}
+
+	servers, err := nqserver.Discover(ctx, *browseTimeout, client)
+	if err != nil {
+		log.Printf("discovery failed: %v", err)
+		return 1
+	}
+
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		if err := encoder.Encode(servers); err != nil {
+			log.Print(err)
+			return 1
+		}
+		return 0
+	}
+
+	if len(servers) == 0 {
+		fmt.Fprintln(os.Stderr, "no servers found")
+		return 0
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "INSTANCE\tCONFIG URL\tADDRESS\tPROTOCOLS\tCAPABILITIES\tSTATUS")
+	for _, s := range servers {
+		status := "ok"
+		capabilities := s.Text["caps"]
+		if s.Reachable() {
+			capabilities = strings.Join(s.Config.Capabilities, ",")
+		} else {
+			status = s.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.Instance, s.ConfigURL, s.Address, dash(s.Text["protos"]), dash(capabilities), status)
+	}
+	if err := w.Flush(); err != nil {
+		log.Print(err)
+		return 1
+	}
+	return 0
+}
+
+func dash(s string) string {
+	if len(s) == 0 {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,224 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"crypto/sha512"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dnsUpdateTimeout bounds each dynamic update exchange.
+const dnsUpdateTimeout = 10 * time.Second
+
+// minDNSUpdateLease is the shortest lease accepted: records are refreshed
+// halfway through it, and their TTL is in whole seconds.
+const minDNSUpdateLease = 30 * time.Second
+
+// A dnsUpdater registers announcements in a unicast DNS zone with RFC 2136
+// dynamic updates, so that they can be browsed from other subnets
+// (RFC 6763 11). The records are refreshed halfway through each lease and
+// deleted on shutdown.
+type dnsUpdater struct {
+	server string
+	zone   string
+	target string
+	lease  time.Duration
+
+	keyName   string
+	algorithm string
+	secret    string
+
+	mut           sync.Mutex
+	announcements []announcement
+}
+
+// newDNSUpdater returns an updater registering records in zone with the
+// server at address. SRV records point at target. tsig is the key to sign
+// updates with, as [algorithm:]name:secret like nsupdate -y, or @file to
+// read it from a file; it may be empty for servers that allow unsigned
+// updates.
+func newDNSUpdater(address, zone, target string, lease time.Duration, tsig string) (*dnsUpdater, error) {
+	if len(zone) == 0 {
+		return nil, errors.New("no zone to register in")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "53")
+	}
+
+	u := &dnsUpdater{
+		server:    address,
+		zone:      dns.Fqdn(zone),
+		target:    dns.Fqdn(target),
+		lease:     lease,
+		algorithm: dns.HmacSHA256,
+	}
+
+	if strings.HasPrefix(tsig, "@") {
+		b, err := os.ReadFile(tsig[1:])
+		if err != nil {
+			return nil, err
+		}
+		tsig = strings.TrimSpace(string(b))
+	}
+	if len(tsig) > 0 {
+		parts := strings.Split(tsig, ":")
+		switch len(parts) {
+		case 2:
+			u.keyName, u.secret = parts[0], parts[1]
+		case 3:
+			u.algorithm, u.keyName, u.secret = dns.Fqdn(strings.ToLower(parts[0])), parts[1], parts[2]
+		default:
+			return nil, errors.New("TSIG key is not [algorithm:]name:secret")
+		}
+		u.keyName = dns.Fqdn(u.keyName)
+	}
+
+	return u, nil
+}
+
+// add registers ann from the next refresh on. It must be called before run.
+func (u *dnsUpdater) add(ann announcement) {
+	u.mut.Lock()
+	defer u.mut.Unlock()
+	u.announcements = append(u.announcements, ann)
+}
+
+// run registers the announcements and keeps them registered until ctx is
+// done.
+func (u *dnsUpdater) run(ctx context.Context) {
+	for {
+		var retry time.Duration
+		if err := u.update(u.register, u.lease); err != nil {
+			log.Printf("could not register %s in %s: %v", serviceName(u.zone), u.zone, err)
+			// Try again soon rather than waiting for the lease.
+			retry = min(30*time.Second, u.lease/2)
+		} else {
+			log.Printf("registered %s in %s with %s for %s", serviceName(u.zone), u.zone, u.server, u.lease)
+			retry = u.lease / 2
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+	}
+}
+
+// remove deletes the records added by run.
+func (u *dnsUpdater) remove() {
+	if err := u.update(u.deregister, 0); err != nil {
+		log.Printf("could not deregister %s from %s: %v", serviceName(u.zone), u.zone, err)
+	}
+}
+
+// register adds the records for the announcements to m, replacing any left
+// from earlier registrations.
+func (u *dnsUpdater) register(m *dns.Msg, ann announcement) {
+	ttl := uint32(u.lease.Seconds())
+	instance := ann.instanceName(u.zone)
+
+	m.RemoveRRset([]dns.RR{
+		&dns.SRV{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeSRV}},
+		&dns.TXT{Hdr: dns.RR_Header{Name: instance, Rrtype: dns.TypeTXT}},
+	})
+	m.Insert(u.records(ann, ttl))
+	m.Insert([]dns.RR{&dns.PTR{
+		Hdr: dns.RR_Header{Name: "_services._dns-sd._udp." + u.zone, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: serviceName(u.zone),
+	}})
+}
+
+// deregister deletes the records for the announcements in m. The service
+// enumeration record is left alone, as other servers may share it.
+func (u *dnsUpdater) deregister(m *dns.Msg, ann announcement) {
+	m.Remove(u.records(ann, 0))
+}
+
+// records returns the PTR, SRV and TXT records of ann.
+func (u *dnsUpdater) records(ann announcement, ttl uint32) []dns.RR {
+	instance := ann.instanceName(u.zone)
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	var txt []string
+	for key, value := range ann.text {
+		txt = append(txt, key+"="+value)
+	}
+	sort.Strings(txt)
+	// A TXT record holds at least one string, empty if there is nothing to
+	// say (RFC 6763 6.1).
+	if len(txt) == 0 {
+		txt = []string{""}
+	}
+
+	rrs := []dns.RR{
+		&dns.PTR{Hdr: header(serviceName(u.zone), dns.TypePTR), Ptr: instance},
+		&dns.SRV{Hdr: header(instance, dns.TypeSRV), Target: u.target, Port: uint16(ann.port)},
+		&dns.TXT{Hdr: header(instance, dns.TypeTXT), Txt: txt},
+	}
+	for _, subtype := range ann.subtypes {
+		rrs = append(rrs, &dns.PTR{Hdr: header(subtypeName(subtype, u.zone), dns.TypePTR), Ptr: instance})
+	}
+	return rrs
+}
+
+// update sends a single update built by calling build for each
+// announcement, asking for lease if positive.
+func (u *dnsUpdater) update(build func(*dns.Msg, announcement), lease time.Duration) error {
+	u.mut.Lock()
+	announcements := u.announcements
+	u.mut.Unlock()
+
+	m := new(dns.Msg)
+	m.SetUpdate(u.zone)
+	for _, ann := range announcements {
+		build(m, ann)
+	}
+
+	// Servers supporting update leases (draft-sekar-dns-ul) expire the
+	// records themselves should we fail to delete them.
+	if lease > 0 {
+		opt := &dns.OPT{Hdr: dns.RR_Header{Name: ".", Rrtype: dns.TypeOPT}}
+		opt.SetUDPSize(dns.DefaultMsgSize)
+		opt.Option = append(opt.Option, &dns.EDNS0_UL{Code: dns.EDNS0UL, Lease: uint32(lease.Seconds())})
+		m.Extra = append(m.Extra, opt)
+	}
+
+	client := &dns.Client{Timeout: dnsUpdateTimeout}
+	if len(u.keyName) > 0 {
+		client.TsigSecret = map[string]string{u.keyName: u.secret}
+		m.SetTsig(u.keyName, u.algorithm, 300, time.Now().Unix())
+	}
+
+	// Servers need not accept UDP messages larger than 512 bytes. Leave room
+	// for the TSIG MAC, which is only added by Exchange.
+	if m.Len()+sha512.Size > dns.MinMsgSize {
+		client.Net = "tcp"
+	}
+
+	r, _, err := client.Exchange(m, u.server)
+	if err == nil && r.Truncated {
+		client.Net = "tcp"
+		r, _, err = client.Exchange(m, u.server)
+	}
+	if err != nil {
+		return err
+	}
+	if r.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("server replied %s", dns.RcodeToString[r.Rcode])
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestNewDNSUpdater(t *testing.T) {
+	tests := []struct {
+		address   string
+		zone      string
+		tsig      string
+		server    string
+		keyName   string
+		algorithm string
+		secret    string
+		wantErr   bool
+	}{
+		{address: "192.0.2.1", zone: "example.com", server: "192.0.2.1:53", algorithm: dns.HmacSHA256},
+		{address: "192.0.2.1:5353", zone: "example.com.", server: "192.0.2.1:5353", algorithm: dns.HmacSHA256},
+		{address: "2001:db8::1", zone: "example.com", server: "[2001:db8::1]:53", algorithm: dns.HmacSHA256},
+		{address: "192.0.2.1", zone: "example.com", tsig: "nq:c2VjcmV0", server: "192.0.2.1:53", keyName: "nq.", algorithm: dns.HmacSHA256, secret: "c2VjcmV0"},
+		{address: "192.0.2.1", zone: "example.com", tsig: "HMAC-SHA512:nq:c2VjcmV0", server: "192.0.2.1:53", keyName: "nq.", algorithm: dns.HmacSHA512, secret: "c2VjcmV0"},
+		{address: "192.0.2.1", zone: "", wantErr: true},
+		{address: "192.0.2.1", zone: "example.com", tsig: "c2VjcmV0", wantErr: true},
+		{address: "192.0.2.1", zone: "example.com", tsig: "a:b:c:d", wantErr: true},
+	}
+	for _, test := range tests {
+		u, err := newDNSUpdater(test.address, test.zone, "nq.example.com", time.Hour, test.tsig)
+		if (err != nil) != test.wantErr {
+			t.Errorf("newDNSUpdater(%q, %q, %q) error = %v, want error %t", test.address, test.zone, test.tsig, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		if u.server != test.server || u.zone != dns.Fqdn(test.zone) || u.target != "nq.example.com." {
+			t.Errorf("newDNSUpdater(%q, %q, %q) updates %s in %s for %s", test.address, test.zone, test.tsig, u.server, u.zone, u.target)
+		}
+		if u.keyName != test.keyName || u.algorithm != test.algorithm || u.secret != test.secret {
+			t.Errorf("newDNSUpdater(%q, %q, %q) has key %q, %q, %q, want %q, %q, %q", test.address, test.zone, test.tsig,
+				u.keyName, u.algorithm, u.secret, test.keyName, test.algorithm, test.secret)
+		}
+	}
+}
+
+func TestDNSUpdaterRecords(t *testing.T) {
+	u := &dnsUpdater{zone: "example.com.", target: "nq.example.com.", lease: time.Hour}
+	tests := []struct {
+		name string
+		ann  announcement
+		ttl  uint32
+		want []string
+	}{
+		{
+			name: "plain",
+			ann:  announcement{name: "nq", port: 4043, text: map[string]string{"scheme": "https", "path": "/.well-known/nq"}},
+			ttl:  3600,
+			want: []string{
+				"_nq._tcp.example.com.\t3600\tIN\tPTR\tnq._nq._tcp.example.com.",
+				"nq._nq._tcp.example.com.\t3600\tIN\tSRV\t0 0 4043 nq.example.com.",
+				"nq._nq._tcp.example.com.\t3600\tIN\tTXT\t\"path=/.well-known/nq\" \"scheme=https\"",
+			},
+		},
+		{
+			name: "subtypes",
+			ann:  announcement{name: "nq", port: 4043, subtypes: []string{"_h2", "_h3"}},
+			ttl:  0,
+			want: []string{
+				"_nq._tcp.example.com.\t0\tIN\tPTR\tnq._nq._tcp.example.com.",
+				"nq._nq._tcp.example.com.\t0\tIN\tSRV\t0 0 4043 nq.example.com.",
+				"nq._nq._tcp.example.com.\t0\tIN\tTXT\t\"\"",
+				"_h2._sub._nq._tcp.example.com.\t0\tIN\tPTR\tnq._nq._tcp.example.com.",
+				"_h3._sub._nq._tcp.example.com.\t0\tIN\tPTR\tnq._nq._tcp.example.com.",
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := rrStrings(u.records(test.ann, test.ttl)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: records() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDNSUpdaterUpdates(t *testing.T) {
+	u := &dnsUpdater{zone: "example.com.", target: "nq.example.com.", lease: time.Hour}
+	ann := announcement{name: "nq", port: 4043, subtypes: []string{"_h2"}}
+	tests := []struct {
+		name  string
+		build func(*dns.Msg, announcement)
+		want  []string
+	}{
+		{
+			name:  "register",
+			build: u.register,
+			want: []string{
+				"nq._nq._tcp.example.com.\t0\tCLASS255\tSRV\t",
+				"nq._nq._tcp.example.com.\t0\tCLASS255\tTXT\t",
+				"_nq._tcp.example.com.\t3600\tIN\tPTR\tnq._nq._tcp.example.com.",
+				"nq._nq._tcp.example.com.\t3600\tIN\tSRV\t0 0 4043 nq.example.com.",
+				"nq._nq._tcp.example.com.\t3600\tIN\tTXT\t\"\"",
+				"_h2._sub._nq._tcp.example.com.\t3600\tIN\tPTR\tnq._nq._tcp.example.com.",
+				"_services._dns-sd._udp.example.com.\t3600\tIN\tPTR\t_nq._tcp.example.com.",
+			},
+		},
+		{
+			name:  "deregister",
+			build: u.deregister,
+			want: []string{
+				"_nq._tcp.example.com.\t0\tNONE\tPTR\tnq._nq._tcp.example.com.",
+				"nq._nq._tcp.example.com.\t0\tNONE\tSRV\t0 0 4043 nq.example.com.",
+				"nq._nq._tcp.example.com.\t0\tNONE\tTXT\t\"\"",
+				"_h2._sub._nq._tcp.example.com.\t0\tNONE\tPTR\tnq._nq._tcp.example.com.",
+			},
+		},
+	}
+	for _, test := range tests {
+		m := new(dns.Msg)
+		m.SetUpdate(u.zone)
+		test.build(m, ann)
+		if got := rrStrings(m.Ns); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: update = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestDNSUpdaterUpdateTSIG(t *testing.T) {
+	const keyName, secret = "nq.", "c2VjcmV0c2VjcmV0c2VjcmV0"
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan *dns.Msg, 1)
+	started := make(chan struct{})
+	server := &dns.Server{
+		PacketConn:        pc,
+		TsigSecret:        map[string]string{keyName: secret},
+		NotifyStartedFunc: func() { close(started) },
+		// The default turns away updates.
+		MsgAcceptFunc: func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+			m := new(dns.Msg)
+			m.SetReply(r)
+			if tsig := r.IsTsig(); tsig == nil || w.TsigStatus() != nil {
+				m.Rcode = dns.RcodeNotAuth
+			} else {
+				m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, 300, time.Now().Unix())
+			}
+			received <- r
+			w.WriteMsg(m)
+		}),
+	}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	<-started
+
+	ann := announcement{name: "nq", port: 4043, text: map[string]string{"scheme": "https"}}
+	tests := []struct {
+		name    string
+		tsig    string
+		wantErr bool
+	}{
+		{name: "signed", tsig: keyName + ":" + secret},
+		{name: "signed with SHA-512", tsig: "hmac-sha512:" + keyName + ":" + secret},
+		{name: "wrong secret", tsig: keyName + ":" + "b3RoZXJzZWNyZXQ=", wantErr: true},
+		{name: "unsigned", wantErr: true},
+	}
+	for _, test := range tests {
+		u, err := newDNSUpdater(pc.LocalAddr().String(), "example.com", "nq.example.com", time.Hour, test.tsig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.add(ann)
+
+		err = u.update(u.register, u.lease)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: update() = %v, want error %t", test.name, err, test.wantErr)
+		}
+		var r *dns.Msg
+		select {
+		case r = <-received:
+		case <-time.After(time.Second):
+			t.Errorf("%s: no update received", test.name)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+
+		tsig := r.IsTsig()
+		if tsig == nil || tsig.Hdr.Name != keyName || tsig.Algorithm != u.algorithm {
+			t.Errorf("%s: update signed with %v, want %s with %s", test.name, tsig, keyName, u.algorithm)
+		}
+		// Compare the records as they went on the wire.
+		want := new(dns.Msg)
+		want.SetUpdate(u.zone)
+		u.register(want, ann)
+		b, err := want.Pack()
+		if err == nil {
+			err = want.Unpack(b)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rrStrings(r.Ns), rrStrings(want.Ns); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: update = %q, want %q", test.name, got, want)
+		}
+		if r.Opcode != dns.OpcodeUpdate || r.Question[0].Name != u.zone {
+			t.Errorf("%s: got opcode %d for %s, want an update of %s", test.name, r.Opcode, r.Question[0].Name, u.zone)
+		}
+		var lease *dns.EDNS0_UL
+		if opt := r.IsEdns0(); opt != nil {
+			for _, o := range opt.Option {
+				if ul, ok := o.(*dns.EDNS0_UL); ok {
+					lease = ul
+				}
+			}
+		}
+		if lease == nil || lease.Lease != 3600 {
+			t.Errorf("%s: update lease = %v, want 3600", test.name, lease)
+		}
+	}
+}
+
+func rrStrings(rrs []dns.RR) []string {
+	var result []string
+	for _, rr := range rrs {
+		result = append(result, rr.String())
+	}
+	return result
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+// dscpNames maps the per-hop behaviours of RFC 4594 (and LE, RFC 8622) to
+// their code points.
+var dscpNames = map[string]int{
+	"be": 0, "df": 0, "le": 1, "ef": 46, "va": 44,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+}
+
+// parseDSCP parses a DSCP name such as "ef" or "af41", or a code point
+// between 0 and 63.
+func parseDSCP(value string) (int, error) {
+	if dscp, ok := dscpNames[strings.ToLower(value)]; ok {
+		return dscp, nil
+	}
+	dscp, err := strconv.ParseUint(value, 10, 6)
+	if err != nil {
+		return 0, fmt.Errorf("invalid DSCP %q", value)
+	}
+	return int(dscp), nil
+}
+
+// parseDSCPMarkings parses -dscp-urls, a comma separated list of DSCP names
+// or code points.
+func parseDSCPMarkings(value string) ([]string, error) {
+	var result []string
+	if len(value) == 0 {
+		return result, nil
+	}
+
+	for _, marking := range strings.Split(value, ",") {
+		marking = strings.TrimSpace(marking)
+		if _, err := parseDSCP(marking); err != nil {
+			return nil, fmt.Errorf("-dscp-urls: %w", err)
+		}
+		result = append(result, marking)
+	}
+
+	return result, nil
+}
+
+// withDSCP applies the DSCP marking requested with nqserver.DSCPParameter
+// to the connection serving the request while h serves it, and puts back
+// tos, the marking of the listening socket, afterwards. Connections whose
+// marking can't be put back are closed.
+//
+// Only HTTP/1.1 connections can be marked: HTTP/2 connections carry other
+// requests at the same time, and QUIC connections share the UDP socket.
+// They are served on -http1-port.
+func withDSCP(h http.Handler, tos int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get(nqserver.DSCPParameter)
+		if len(value) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		dscp, err := parseDSCP(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tcpConn, ok := nqserver.TCPConnFromContext(r.Context())
+		if !ok || r.ProtoMajor != 1 {
+			http.Error(w, "DSCP marking is only supported over HTTP/1.1", http.StatusNotImplemented)
+			return
+		}
+
+		// The kernel owns the ECN bits of TCP connections.
+		setDSCP := func(value int) error {
+			return controlSocket(tcpConn, tcpConn.LocalAddr(), func(network, address string, conn syscall.RawConn) error {
+				return setIPTos(network, conn, value)
+			})
+		}
+		if err := setDSCP(dscp << 2); err != nil {
+			log.Printf("could not set DSCP %d for %s: %v", dscp, r.RemoteAddr, err)
+			http.Error(w, fmt.Sprintf("could not set DSCP %d", dscp), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			if err := setDSCP(tos); err != nil {
+				log.Printf("could not restore DSCP for %s, closing the connection: %v", r.RemoteAddr, err)
+				closeAfterResponse(w, tcpConn)
+			}
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// closeAfterResponse closes c, the connection of w, once what was written to
+// w has been sent, so that no further requests are served on it.
+func closeAfterResponse(w http.ResponseWriter, c net.Conn) {
+	_ = http.NewResponseController(w).Flush()
+	c.Close()
+}
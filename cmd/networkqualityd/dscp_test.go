@@ -0,0 +1,153 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+func TestParseDSCP(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{value: "ef", want: 46},
+		{value: "EF", want: 46},
+		{value: "af41", want: 34},
+		{value: "cs1", want: 8},
+		{value: "le", want: 1},
+		{value: "be", want: 0},
+		{value: "0", want: 0},
+		{value: "63", want: 63},
+		{value: "64", wantErr: true},
+		{value: "-1", wantErr: true},
+		{value: "af44", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseDSCP(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseDSCP(%q) error = %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseDSCP(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestParseDSCPMarkings(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: nil},
+		{value: "ef", want: []string{"ef"}},
+		{value: "ef, af41,10", want: []string{"ef", "af41", "10"}},
+		{value: "ef,bogus", wantErr: true},
+		{value: "ef,", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseDSCPMarkings(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseDSCPMarkings(%q) error = %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseDSCPMarkings(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestDSCPURLs(t *testing.T) {
+	m := &nqserver.Server{Scheme: "https", DSCPMarkings: []string{"ef", "af41"}}
+	s := startHTTP1Port(t, m, func(h http.Handler) http.Handler { return withDSCP(h, 0) })
+	client := s.Client()
+
+	var config struct {
+		DSCPURLs []struct {
+			DSCP             string `json:"dscp"`
+			SmallDownloadURL string `json:"small_download_url"`
+			LargeDownloadURL string `json:"large_download_url"`
+			UploadURL        string `json:"upload_url"`
+		} `json:"dscp_urls"`
+	}
+	fetchConfig(t, client, s.URL, &config)
+	if len(config.DSCPURLs) != len(m.DSCPMarkings) {
+		t.Fatalf("config lists %d DSCP markings, want %d", len(config.DSCPURLs), len(m.DSCPMarkings))
+	}
+
+	for _, urls := range config.DSCPURLs {
+		// The large download is only asked for, not sent.
+		for _, request := range []struct{ method, url string }{
+			{http.MethodGet, urls.SmallDownloadURL},
+			{http.MethodHead, urls.LargeDownloadURL},
+		} {
+			req, _ := http.NewRequest(request.method, request.url, nil)
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Errorf("%s %s: %v", request.method, request.url, err)
+				continue
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+				t.Errorf("%s %s = %s over %s, want 200 over HTTP/1.1", request.method, request.url, resp.Status, resp.Proto)
+			}
+		}
+		resp, err := client.Post(urls.UploadURL, "application/octet-stream", strings.NewReader(strings.Repeat("x", 1000)))
+		if err != nil {
+			t.Errorf("POST %s: %v", urls.UploadURL, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+			t.Errorf("POST %s = %s over %s, want 200 over HTTP/1.1", urls.UploadURL, resp.Status, resp.Proto)
+		}
+	}
+}
+
+// startHTTP1Port serves the config and measurement URLs of m, wrapped by
+// wrap, as on -http1-port, which it makes m's HTTP1Endpoint. Its client would
+// rather use HTTP/2.
+func startHTTP1Port(t *testing.T, m *nqserver.Server, wrap func(http.Handler) http.Handler) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/nq", m.ConfigHandler)
+	for pattern, handler := range nqserver.CountingBulkHandlers("", false, &m.BytesServed, &m.BytesReceived) {
+		mux.Handle(pattern, wrap(handler))
+	}
+
+	s := httptest.NewUnstartedServer(mux)
+	s.EnableHTTP2 = true
+	s.TLS = http1TLSConfig(&tls.Config{})
+	s.Config.ConnContext = m.ConnContext
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	m.PublicHostPort = strings.TrimPrefix(s.URL, "https://")
+	m.HTTP1Endpoint = &nqserver.HTTP1Endpoint{Scheme: "https", PublicHostPort: m.PublicHostPort}
+	return s
+}
+
+// fetchConfig decodes the config served at baseURL into v.
+func fetchConfig(t *testing.T, client *http.Client, baseURL string, v any) {
+	resp, err := client.Get(baseURL + "/.well-known/nq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+// tcpECNInfo is the ECN state of a TCP connection, as reported by TCP_INFO.
+type tcpECNInfo struct {
+	Negotiated  bool   // ECN was agreed on during the handshake
+	Seen        bool   // at least one ECT packet was received
+	DeliveredCE uint32 // packets the peer reported as CE marked
+}
+
+// ecnListener checks the congestion control and ECN state of each
+// connection it accepts, counting them in m. With debug set, the ECN state
+// of each connection is also logged when it closes.
+type ecnListener struct {
+	net.Listener
+	m                 *nqserver.Server
+	congestionControl string
+	debug             bool
+}
+
+func (l *ecnListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	tcpConn, ok := c.(*net.TCPConn)
+	if !ok {
+		return c, nil
+	}
+
+	if rawConn, err := tcpConn.SyscallConn(); err == nil {
+		actual, err := getTCPCongestion(rawConn)
+		if err == nil && actual != l.congestionControl {
+			log.Printf("connection from %s uses congestion control %q instead of %q", c.RemoteAddr(), actual, l.congestionControl)
+		}
+	}
+
+	return &ecnConn{TCPConn: tcpConn, m: l.m, debug: l.debug}, nil
+}
+
+// ecnConn reads the ECN state of the connection before it is closed.
+type ecnConn struct {
+	*net.TCPConn
+	m     *nqserver.Server
+	debug bool
+	once  sync.Once
+}
+
+// NetConn returns the underlying connection, like tls.Conn does.
+func (c *ecnConn) NetConn() net.Conn {
+	return c.TCPConn
+}
+
+func (c *ecnConn) Close() error {
+	c.once.Do(c.recordECN)
+	return c.TCPConn.Close()
+}
+
+func (c *ecnConn) recordECN() {
+	rawConn, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+
+	info, err := getTCPECNInfo(rawConn)
+	if err != nil {
+		return
+	}
+
+	if info.Negotiated {
+		atomic.AddUint64(&c.m.ECNConnections, 1)
+	}
+	atomic.AddUint64(&c.m.CEMarks, uint64(info.DeliveredCE))
+
+	if !c.debug {
+		return
+	}
+	log.Printf("connection from %s closed: ECN negotiated=%t seen=%t, %d CE marked packets delivered",
+		c.RemoteAddr(), info.Negotiated, info.Seen, info.DeliveredCE)
+}
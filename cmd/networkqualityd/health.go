@@ -0,0 +1,112 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// sendRateInterval is how often the sending rate is sampled for /readyz.
+const sendRateInterval = time.Second
+
+// drainRetryAfter is how long clients turned away while draining are asked
+// to wait, in seconds.
+const drainRetryAfter = "30"
+
+// isBulkPattern reports whether requests for the measurement handler
+// pattern are bulk transfers, as opposed to latency probes.
+func isBulkPattern(pattern string) bool {
+	for _, suffix := range []string{"/large", "/slurp", "/ws/download", "/ws/upload"} {
+		if strings.HasSuffix(pattern, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// admit returns a handler that turns h's requests away while draining. It
+// wraps the config, so that no new tests start, while the measurement
+// requests of tests under way are still served.
+func (a *adminServer) admit(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.draining.Load() {
+			w.Header().Set("Connection", "close")
+			w.Header().Set("Retry-After", drainRetryAfter)
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// countBulk returns a handler counting the bulk transfers of h in flight.
+func (a *adminServer) countBulk(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		a.bulkStreams.Add(1)
+		defer a.bulkStreams.Add(-1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serve runs serve, counting a listener added to a.listeners as serving
+// until it returns.
+func (a *adminServer) serve(serve func() error) error {
+	a.serving.Add(1)
+	defer a.serving.Add(-1)
+	return serve()
+}
+
+// monitorSendRate samples the bytes served by all servers to keep track of
+// the rate we send at, until a.ctx is done.
+func (a *adminServer) monitorSendRate() {
+	ticker := time.NewTicker(sendRateInterval)
+	defer ticker.Stop()
+
+	last, lastTime := a.bytesServed(), time.Now()
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case now := <-ticker.C:
+			bytes := a.bytesServed()
+			if elapsed := now.Sub(lastTime).Seconds(); elapsed > 0 {
+				a.sendRate.Store(uint64(float64(bytes-last) / elapsed))
+			}
+			last, lastTime = bytes, now
+		}
+	}
+}
+
+func (a *adminServer) bytesServed() uint64 {
+	var total uint64
+	for _, m := range a.measurementServers() {
+		total += atomic.LoadUint64(&m.BytesServed)
+	}
+	return total
+}
+
+// readiness reports whether load balancers should send us new clients, and
+// if not, why.
+func (a *adminServer) readiness() (bool, string) {
+	switch {
+	case a.draining.Load():
+		return false, "draining"
+	case !a.ready.Load():
+		return false, "not ready"
+	}
+
+	if serving, listeners := a.serving.Load(), a.listeners.Load(); serving < listeners {
+		return false, fmt.Sprintf("%d of %d listeners serving", serving, listeners)
+	}
+	if streams := a.bulkStreams.Load(); a.maxBulkStreams > 0 && streams >= a.maxBulkStreams {
+		return false, fmt.Sprintf("saturated: %d bulk transfers in flight", streams)
+	}
+	if rate := a.sendRate.Load(); a.maxSendRate > 0 && rate >= a.maxSendRate {
+		return false, fmt.Sprintf("saturated: sending %.1f Mbit/s", float64(rate)*8/1e6)
+	}
+	return true, "ok"
+}
@@ -10,28 +10,26 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"syscall"
 	"time"
 
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/likexian/selfca"
 	nqserver "github.com/network-quality/goserver"
 
-	// Do *not* remove this import. Per https://pkg.go.dev/net/http/pprof:
-	// The package is typically only imported for the side effect of registering
-	// its HTTP handlers. The handled paths all begin with /debug/pprof/.
-	// See -debug for how we use it.
-	_ "net/http/pprof"
-
 	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
 	"golang.org/x/net/http2"
 	"golang.org/x/net/http2/h2c"
 )
@@ -44,22 +42,76 @@ var (
 
 	announce    = flag.Bool("announce", false, "announce this server using DNS-SD")
 	createCert  = flag.Bool("create-cert", false, "generate self-signed certs")
-	debug       = flag.Bool("debug", false, "enable debug mode")
+	debug       = flag.Bool("debug", false, "enable debug mode: log throughput stats and the ECN state of connections with a chosen congestion control, and serve the admin interface, on 127.0.0.1:9090 unless -admin-addr is given")
 	enableCORS  = flag.Bool("enable-cors", false, "enable CORS headers")
 	enableH2C   = flag.Bool("enable-h2c", false, "enable h2c (non-TLS http/2 prior knowledge) mode")
 	enableHTTP2 = flag.Bool("enable-http2", true, "enable HTTP/2")
 	enableHTTP3 = flag.Bool("enable-http3", false, "enable HTTP/3")
+	enableMPTCP = flag.Bool("enable-mptcp", false, "listen with Multipath TCP (Linux only); clients without MPTCP fall back to TCP. Upload summaries tell whether their connection negotiated it, and the admin metrics count the connections that did")
 	showVersion = flag.Bool("version", false, "Show version")
 
+	acceptors = flag.Int("acceptors", 1, "Number of listening sockets (and servers) per port. Values greater than one use SO_REUSEPORT to spread connections across them")
+
+	adminAddr  = flag.String("admin-addr", "", "Address (host:port) to serve the admin interface on: pprof, metrics, health checks, connections, config and control actions. Addresses other than loopback ones require -admin-token")
+	adminToken = flag.String("admin-token", "", "Bearer token required by the admin interface, except for its health checks, or @file to read it from a file")
+
+	saturationBulkStreams = flag.Int("saturation-bulk-streams", 0, "Report not ready on the admin /readyz while this many bulk transfers (/large, /slurp) are in flight. Zero means no limit")
+	saturationSendRate    = flag.String("saturation-send-rate", "", "Report not ready on the admin /readyz while sending at this rate or faster, in bits per second with an optional k, M or G suffix")
+
+	statsInterval = flag.Duration("stats-interval", time.Second, "How often to report throughput stats (see -debug and -stats-json)")
+	statsJSON     = flag.String("stats-json", "", "Append a JSON line with the throughput of each measurement port, and in total, to this file every -stats-interval")
+
+	resultsFile      = flag.String("results-file", "", "Accept test results POSTed by clients to /results, which is listed in the config, and append them to this JSON lines file. The admin interface serves them at /results")
+	resultsMaxMB     = flag.Int("results-max-mb", 100, "Stop accepting results once -results-file reaches this size in megabytes. Admin queries read the whole file. Zero means no limit")
+	resultsPerClient = flag.Int("results-per-client", 60, "How many results each client address may submit per hour. Zero means no limit")
+
+	udpEchoPort = flag.Int("udp-echo-port", 0, "The port to reflect TWAMP light (RFC 5357) test packets on, which is listed in the config. Zero disables the UDP echo service")
+	udpEchoRate = flag.Float64("udp-echo-rate", 100, "Packets per second reflected to each client address by the UDP echo service, in bursts of up to a second's worth")
+
+	enableWebSocket    = flag.Bool("enable-websocket", false, "Serve WebSocket measurements at /ws/download, /ws/upload and /ws/ping, which are listed in the config")
+	enableRawQUIC      = flag.Bool("enable-raw-quic", false, "Accept raw QUIC measurement connections with the nq-quic ALPN on the HTTP/3 port, which is listed in the config (requires -enable-http3)")
+	enableWebTransport = flag.Bool("enable-webtransport", false, "Serve WebTransport measurements over HTTP/3 at /webtransport, which is listed in the config (requires -enable-http3)")
+	enableWebUI        = flag.Bool("enable-web-ui", false, "Serve a page testing the server from a browser at the context path's /ui/, which browsers opening the context path are sent to")
+
+	enableSessions     = flag.Bool("enable-sessions", false, "Mint a session for each config served, embedded in the URLs it lists, and sum up the measurements made for it. Sessions are logged when they finish and the admin interface serves them at /sessions")
+	sessionIdleTimeout = flag.Duration("session-idle-timeout", 30*time.Second, "How long a session may go without requests before it finishes")
+	sessionsJSON       = flag.String("sessions-json", "", "Append a JSON line for each finished session to this file (implies -enable-sessions)")
+
+	statsdAddr   = flag.String("statsd-addr", "", "Send metrics to the StatsD server at host:port, for each measurement request and every -stats-interval")
+	statsdPrefix = flag.String("statsd-prefix", "networkquality", "Prefix of StatsD metric names")
+	statsdTags   = flag.String("statsd-tags", "", "Comma separated key:value tags to add to every StatsD metric, e.g. env:prod,region:eu")
+	dogStatsD    = flag.Bool("dogstatsd", false, "Send StatsD tags in the DogStatsD format rather than appending their values to metric names")
+
+	otlpEndpoint = flag.String("otlp-endpoint", "", "Export a span per measurement request and the server counters to the OpenTelemetry collector at host:port")
+	otlpProtocol = flag.String("otlp-protocol", "grpc", "Protocol to export to -otlp-endpoint with: grpc or http")
+	otlpInsecure = flag.Bool("otlp-insecure", false, "Export to -otlp-endpoint without TLS")
+
+	upgradeDrainTimeout = flag.Duration("upgrade-drain-timeout", 30*time.Second, "How long in-flight transfers may run after handing the listeners to an upgraded process (SIGUSR2)")
+
 	socketSendBuffer = flag.Uint("socket-send-buffer-size", 0, "The size of the socket send buffer via TCP_NOTSENT_LOWAT. Zero/unset means to leave unset")
 
 	enableL4s          = flag.Bool("enable-l4s", false, fmt.Sprintf("Enable L4S using the default congestion control algorithm, %s.", defaultL4SCongestionControlAlgorithm))
 	enableL4sAlgorithm = flag.String("enable-l4s-algorithm", "", "Enable L4S using the specified congestion control algorithm")
 
-	announceName = flag.String("announceName", "", "Name to use for DNS-SD announcement (defaults to --config-name")
-	tosString    = flag.String("tos", "0", "set TOS for listening socket")
-	certFilename = flag.String("cert-file", "", "cert to use")
-	keyFilename  = flag.String("key-file", "", "key to use")
+	congestionControlPorts = flag.String("congestion-control-ports", "", "Comma separated algorithm=port pairs, e.g. cubic=4044,bbr=4045. Each port serves the measurement URLs using that TCP congestion control algorithm, and all of them are listed in the config")
+
+	http1Port  = flag.Int("http1-port", 0, "Serve the measurement URLs over HTTP/1.1 only on this extra port, listed in the config. Requests choose socket options, such as -enable-dscp, there")
+	enableDSCP = flag.Bool("enable-dscp", false, "Let clients choose the DSCP marking of a measurement request on -http1-port with the dscp request parameter, e.g. /large?dscp=ef")
+	dscpURLs   = flag.String("dscp-urls", "", "Comma separated DSCP names or values, e.g. ef,af41,be. The config lists measurement URLs of -http1-port requesting each of them (implies -enable-dscp)")
+
+	maxPacingRate    = flag.String("max-pacing-rate", "", "Cap the sending rate of every measurement connection in the kernel via SO_MAX_PACING_RATE (Linux only), in bits per second with an optional k, M or G suffix")
+	enablePacingRate = flag.Bool("enable-pacing-rate", false, "Let clients cap the sending rate of a measurement request on -http1-port with the max_pacing_rate request parameter, e.g. /large?max_pacing_rate=50M (Linux only)")
+
+	announceName  = flag.String("announceName", "", "Name to use for DNS-SD announcement (defaults to --config-name")
+	announcePorts = flag.String("announce-ports", "", "Comma separated ports to announce with -announce or -dns-update-server (defaults to the HTTPS and HTTP measurement ports)")
+
+	dnsUpdateServer = flag.String("dns-update-server", "", "Register the announced ports in a unicast DNS zone with RFC 2136 dynamic updates sent to this server (host[:port])")
+	dnsUpdateZone   = flag.String("dns-update-zone", "", "Zone to register in with -dns-update-server, e.g. example.com")
+	dnsUpdateTSIG   = flag.String("dns-update-tsig", "", "TSIG key to sign dynamic updates with, as [algorithm:]name:secret (like nsupdate -y) or @file")
+	dnsUpdateLease  = flag.Duration("dns-update-lease", time.Hour, "TTL of the records registered with -dns-update-server, at least 30s; they are refreshed halfway through")
+	tosString       = flag.String("tos", "0", "set TOS for listening socket")
+	certFilename    = flag.String("cert-file", "", "cert to use")
+	keyFilename     = flag.String("key-file", "", "key to use")
 
 	configName  = flag.String("config-name", "networkquality.example.com", "domain to generate config for")
 	publicName  = flag.String("public-name", "", "host to generate config for (same as -config-name if not specified)")
@@ -73,6 +125,10 @@ const (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "discover" {
+		os.Exit(discoverMain(os.Args[2:]))
+	}
+
 	flag.Parse()
 
 	if *showVersion {
@@ -86,6 +142,115 @@ func main() {
 	}
 	tos := uint8(tosTemp)
 
+	dscpMarkings, err := parseDSCPMarkings(*dscpURLs)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(dscpMarkings) > 0 {
+		*enableDSCP = true
+	}
+	// HTTP/2 and HTTP/3 requests share their connection with others.
+	if *enableDSCP && *http1Port == 0 {
+		log.Fatal("-enable-dscp: DSCP markings are only applied on -http1-port")
+	}
+
+	var pacingRate uint64
+	if len(*maxPacingRate) > 0 {
+		if pacingRate, err = parseBitRate(*maxPacingRate); err != nil {
+			log.Fatalf("-max-pacing-rate: %v", err)
+		}
+	}
+	if *enablePacingRate && *http1Port == 0 {
+		log.Fatal("-enable-pacing-rate: pacing rates are only applied on -http1-port")
+	}
+	if pacingRate > 0 || *enablePacingRate {
+		warnUnlessFQ()
+	}
+
+	var saturationRate uint64
+	if len(*saturationSendRate) > 0 {
+		if saturationRate, err = parseBitRate(*saturationSendRate); err != nil {
+			log.Fatalf("-saturation-send-rate: %v", err)
+		}
+	}
+
+	if *statsInterval <= 0 {
+		log.Fatalf("-stats-interval must be positive, not %s", *statsInterval)
+	}
+	var statsSinks []nqserver.StatsSink
+	if len(*statsJSON) > 0 {
+		sink, err := nqserver.NewJSONStatsFileSink(*statsJSON)
+		if err != nil {
+			log.Fatalf("-stats-json: %v", err)
+		}
+		defer sink.Close()
+		statsSinks = append(statsSinks, sink)
+	}
+	var results *nqserver.ResultStore
+	if len(*resultsFile) > 0 {
+		if *resultsMaxMB < 0 || *resultsPerClient < 0 {
+			log.Fatal("-results-max-mb and -results-per-client must not be negative")
+		}
+		if results, err = nqserver.OpenResultStore(*resultsFile, nqserver.ResultLimits{
+			MaxSize:          int64(*resultsMaxMB) << 20,
+			PerClientPerHour: *resultsPerClient,
+		}); err != nil {
+			log.Fatalf("-results-file: %v", err)
+		}
+		defer results.Close()
+	}
+	var sessions *nqserver.SessionTracker
+	if *enableSessions || len(*sessionsJSON) > 0 {
+		if *sessionIdleTimeout <= 0 {
+			log.Fatalf("-session-idle-timeout must be positive, not %s", *sessionIdleTimeout)
+		}
+		sessionSinks := []nqserver.SessionSink{nqserver.LogSessionSink{}}
+		if len(*sessionsJSON) > 0 {
+			sink, err := nqserver.NewJSONSessionFileSink(*sessionsJSON)
+			if err != nil {
+				log.Fatalf("-sessions-json: %v", err)
+			}
+			defer sink.Close()
+			sessionSinks = append(sessionSinks, sink)
+		}
+		sessions = nqserver.NewSessionTracker(*sessionIdleTimeout, sessionSinks...)
+	}
+	var statsd *nqserver.StatsDClient
+	if len(*statsdAddr) > 0 {
+		var tags []string
+		for _, tag := range strings.Split(*statsdTags, ",") {
+			if tag = strings.TrimSpace(tag); len(tag) > 0 {
+				tags = append(tags, tag)
+			}
+		}
+		if statsd, err = nqserver.NewStatsDClient(*statsdAddr, *statsdPrefix, tags, *dogStatsD); err != nil {
+			log.Fatalf("-statsd-addr: %v", err)
+		}
+		defer statsd.Close()
+		statsSinks = append(statsSinks, statsd)
+	}
+
+	if *enableWebTransport && !*enableHTTP3 {
+		log.Fatal("-enable-webtransport requires -enable-http3")
+	}
+	if *enableRawQUIC && !*enableHTTP3 {
+		log.Fatal("-enable-raw-quic requires -enable-http3")
+	}
+	if *udpEchoPort > 0 && *udpEchoRate <= 0 {
+		log.Fatalf("-udp-echo-rate must be positive, not %v", *udpEchoRate)
+	}
+
+	if *acceptors < 1 {
+		log.Fatalf("-acceptors must be at least 1, not %d", *acceptors)
+	}
+
+	// Sockets may be handed to us by systemd rather than bound here, which
+	// allows listening on privileged ports without running as root.
+	activated, err := activatedSocketsFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	operatingCtx, operatingCtxCancel := context.WithCancel(context.Background())
 	defer operatingCtxCancel()
 
@@ -158,16 +323,18 @@ func main() {
 	}
 
 	var cfg *tls.Config
+	var certs *certStore
 	if certSpecified {
 		cfg = &tls.Config{
 			MinVersion: tls.VersionTLS12,
 		}
 
-		cfg.Certificates = make([]tls.Certificate, 1)
-		cfg.Certificates[0], err = tls.LoadX509KeyPair(*certFilename, *keyFilename)
+		// The certificate can be reloaded through the admin interface.
+		certs, err = newCertStore(*certFilename, *keyFilename)
 		if err != nil {
 			log.Fatal(err)
 		}
+		cfg.GetCertificate = certs.getCertificate
 
 		if *enableHTTP2 {
 			cfg.NextProtos = []string{"h2"}
@@ -179,9 +346,11 @@ func main() {
 	}
 
 	portScheme := make(map[int]string)
+	primaryScheme := "https"
 	if *enableH2C || !certSpecified {
 		*insecurePublicPort = defaultInsecurePublicPort
 		portScheme[*insecurePublicPort] = "http"
+		primaryScheme = "http"
 	} else {
 		portScheme[*publicPort] = "https"
 		if *insecurePublicPort > 0 {
@@ -189,224 +358,722 @@ func main() {
 		}
 	}
 
-	if *debug {
+	// Ports dedicated to a congestion control algorithm are served like the
+	// primary measurement port.
+	congestionControlEndpoints, err := parseCongestionControlPorts(*congestionControlPorts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	portCongestionControl := make(map[int]string)
+	var ccEndpoints []nqserver.CongestionControlEndpoint
+	for _, e := range congestionControlEndpoints {
+		if _, ok := portScheme[e.port]; ok {
+			log.Fatalf("-congestion-control-ports: port %d is already in use", e.port)
+		}
+		portScheme[e.port] = primaryScheme
+		portCongestionControl[e.port] = e.algorithm
+		ccEndpoints = append(ccEndpoints, nqserver.CongestionControlEndpoint{
+			Algorithm:      e.algorithm,
+			Scheme:         primaryScheme,
+			PublicHostPort: publicHostPort(e.port),
+		})
+	}
+
+	// The HTTP/1.1 port is served like the primary measurement port, but
+	// without HTTP/2 or HTTP/3.
+	var http1Endpoint *nqserver.HTTP1Endpoint
+	if *http1Port > 0 {
+		if _, ok := portScheme[*http1Port]; ok {
+			log.Fatalf("-http1-port: port %d is already in use", *http1Port)
+		}
+		portScheme[*http1Port] = primaryScheme
+		http1Endpoint = &nqserver.HTTP1Endpoint{
+			Scheme:         primaryScheme,
+			PublicHostPort: publicHostPort(*http1Port),
+		}
+	}
+
+	var mut sync.Mutex
+	var servers []*http.Server
+	var h3Servers []h3Server
+	var h3Requests int64
+	quicGate := &quicAcceptGate{}
+
+	// The raw sockets we serve on, to be passed on by an upgrade.
+	var handoffListeners []net.Listener
+	var handoffPacketConns []net.PacketConn
+
+	var wg sync.WaitGroup
+
+	conns := newConnTracker()
+	admin, err := newAdminServer(operatingCtx, *adminToken, conns, certs, &h3Requests)
+	if err != nil {
+		log.Fatalf("-admin-token: %v", err)
+	}
+	admin.statsInterval = *statsInterval
+	admin.results = results
+	admin.sessions = sessions
+	admin.maxBulkStreams = int64(*saturationBulkStreams)
+	admin.maxSendRate = saturationRate
+
+	var tel *telemetry
+	if len(*otlpEndpoint) > 0 {
+		if tel, err = newTelemetry(operatingCtx, *otlpEndpoint, *otlpProtocol, *otlpInsecure, admin.measurementServers); err != nil {
+			log.Fatalf("-otlp-endpoint: %v", err)
+		}
+		log.Printf("Exporting telemetry to %s over %s", *otlpEndpoint, *otlpProtocol)
+	}
+
+	if len(*adminAddr) == 0 && *debug {
+		*adminAddr = defaultAdminAddr
+	}
+	var adminHTTPServer *http.Server
+	if len(*adminAddr) > 0 {
+		// The admin interface can drain the server and close connections.
+		if len(admin.token) == 0 && !isLoopbackAddr(*adminAddr) {
+			log.Fatalf("-admin-addr: %s is reachable from other hosts, which requires -admin-token", *adminAddr)
+		}
+		nl, err := listenAdmin(operatingCtx, activated, *adminAddr)
+		if err != nil {
+			log.Fatalf("-admin-addr: %v", err)
+		}
+		handoffListeners = append(handoffListeners, nl)
+
+		log.Printf("Admin interface on http://%s/", nl.Addr())
+		adminHTTPServer = &http.Server{
+			Handler:           admin.handler(),
+			ReadHeaderTimeout: 3 * time.Second,
+		}
 		go func() {
-			debugListenPort := 9090
-			debugListenAddr := fmt.Sprintf("%s:%d", *listenAddr, debugListenPort)
-			server := &http.Server{
-				Addr:              debugListenAddr,
-				ReadHeaderTimeout: 3 * time.Second,
+			if err := adminHTTPServer.Serve(nl); !errors.Is(err, http.ErrServerClosed) {
+				log.Fatal(err)
 			}
+		}()
+	}
 
-			err := server.ListenAndServe()
+	// Each measurement listener is announced as its own instance, the
+	// primary one under -announceName and the others qualified by scheme
+	// and port.
+	var announcer *announcer
+	announced := make(map[int]bool)
+	primaryPort := *publicPort
+	if primaryScheme == "http" {
+		primaryPort = *insecurePublicPort
+	}
+	var updater *dnsUpdater
+	if *announce {
+		if announcer, err = newAnnouncer(*listenAddr, *announceName); err != nil {
+			log.Fatalf("Could not announce the server instance: %v", err)
+		}
+	}
+	if len(*dnsUpdateServer) > 0 {
+		if *dnsUpdateLease < minDNSUpdateLease {
+			log.Fatalf("-dns-update-lease: %s is shorter than %s", *dnsUpdateLease, minDNSUpdateLease)
+		}
+		if updater, err = newDNSUpdater(*dnsUpdateServer, *dnsUpdateZone, *publicName, *dnsUpdateLease, *dnsUpdateTSIG); err != nil {
+			log.Fatalf("-dns-update-server: %v", err)
+		}
+	}
+	if announcer != nil || updater != nil {
+		if len(*announcePorts) == 0 {
+			for port := range portScheme {
+				if _, dedicated := portCongestionControl[port]; !dedicated && port != *http1Port {
+					announced[port] = true
+				}
+			}
+		}
+		for _, portString := range strings.Split(*announcePorts, ",") {
+			if len(portString) == 0 {
+				continue
+			}
+			port, err := strconv.Atoi(strings.TrimSpace(portString))
 			if err != nil {
-				log.Fatal(err)
+				log.Fatalf("-announce-ports: invalid port %q", portString)
 			}
-		}()
+			if _, ok := portScheme[port]; !ok {
+				log.Fatalf("-announce-ports: not serving on port %d", port)
+			}
+			announced[port] = true
+		}
 	}
 
-	var announceShutdowners []func()
-	var servers []*http.Server
+	var l4sAlgorithm string
+	if *enableL4s || *enableL4sAlgorithm != "" {
+		l4sAlgorithm = defaultL4SCongestionControlAlgorithm
+		if *enableL4sAlgorithm != "" {
+			l4sAlgorithm = *enableL4sAlgorithm
+		}
+	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(portScheme))
+	var capabilities []string
+	if l4sAlgorithm != "" {
+		capabilities = append(capabilities, "l4s")
+	}
+	if *enableMPTCP {
+		capabilities = append(capabilities, "mptcp")
+	}
+	if *enableDSCP {
+		capabilities = append(capabilities, "dscp")
+	}
+	if *enablePacingRate {
+		capabilities = append(capabilities, "pacing")
+	}
 
-	ips := make([]net.IP, 0)
-	if *announce {
-		// The user may give us a hostname (rather than an address to listen on). In order to
-		// handle this situation, we will use DNS to convert it to an IP. As a result, we may
-		// get back more than one address -- handle that!
-		if addresses, lookupErr := net.LookupHost(*listenAddr); lookupErr == nil {
-			for _, addr := range addresses {
-				if parsedAddr := net.ParseIP(addr); parsedAddr != nil {
-					ips = append(ips, parsedAddr)
+	// controlFor returns a function applying the socket options requested on
+	// the command line to a TCP listener, whether we bind it or inherit it.
+	// Accepted connections inherit the listener's congestion control.
+	controlFor := func(congestionControl string) func(network, address string, conn syscall.RawConn) error {
+		return func(network, address string, conn syscall.RawConn) error {
+			// Accepted sockets inherit the listener's maximum pacing rate.
+			if pacingRate > 0 {
+				log.Printf("setting SO_MAX_PACING_RATE to %d bytes/s", pacingRate)
+				if err := setMaxPacingRate(conn, pacingRate); err != nil {
+					return err
+				}
+			}
+			if *socketSendBuffer > 0 {
+				log.Printf("setting TCP_NOTSENT_LOWAT to %d", *socketSendBuffer)
+				if err := setTCPNotSentLowat(conn, int(*socketSendBuffer)); err != nil {
+					return err
+				}
+			}
+
+			if congestionControl != "" {
+				log.Printf("setting TCP_CONGESTION to %v", congestionControl)
+				if err := setTCPL4S(conn, congestionControl); err != nil {
+					return err
+				}
+
+				// Don't advertise an algorithm unless the kernel really uses it.
+				actual, err := getTCPCongestion(conn)
+				if err != nil {
+					return err
+				}
+				if actual != congestionControl {
+					return fmt.Errorf("TCP_CONGESTION is %q after setting it to %q", actual, congestionControl)
+				}
+			}
+
+			if tos > 0 {
+				log.Printf("Setting IP_TOS to %d", tos)
+				if err := setIPTos(network, conn, int(tos)); err != nil {
+					return err
+				}
+			}
+
+			if *acceptors > 1 {
+				if err := setReusePort(conn); err != nil {
+					return err
 				}
 			}
+			return nil
 		}
 	}
 
-	var mut sync.Mutex
-	for port, scheme := range portScheme {
-		var hostPort string
-		if port == 80 || port == 443 {
-			hostPort = *publicName
+	packetListenConfig := net.ListenConfig{
+		Control: func(network, address string, conn syscall.RawConn) error {
+			if *acceptors > 1 {
+				return setReusePort(conn)
+			}
+			return nil
+		},
+	}
+
+	// The UDP echo service has a port of its own, which HTTP/3 mustn't
+	// share.
+	var udpEchoConn net.PacketConn
+	var udpEchoHostPort string
+	if *udpEchoPort > 0 {
+		if portScheme[*udpEchoPort] == "https" && *enableHTTP3 {
+			log.Fatalf("-udp-echo-port: port %d is already in use by HTTP/3", *udpEchoPort)
+		}
+		if udpEchoConn = activated.packetConn(*udpEchoPort); udpEchoConn != nil {
+			log.Printf("Using inherited UDP socket on %s", udpEchoConn.LocalAddr())
 		} else {
-			hostPort = fmt.Sprintf("%s:%d", *publicName, port)
+			udpEchoConn, err = net.ListenPacket("udp", fmt.Sprintf("%s:%d", *listenAddr, *udpEchoPort))
+			if err != nil {
+				log.Fatalf("-udp-echo-port: %v", err)
+			}
 		}
+		handoffPacketConns = append(handoffPacketConns, udpEchoConn)
+		udpEchoHostPort = net.JoinHostPort(*publicName, strconv.Itoa(*udpEchoPort))
 
+		udpEcho := &nqserver.UDPEchoServer{Rate: *udpEchoRate, Burst: int(math.Ceil(*udpEchoRate))}
+		admin.udpEcho = udpEcho
+		admin.listeners.Add(1)
+		log.Printf("UDP echo on %s", udpEchoConn.LocalAddr())
+		go func() {
+			activated.waitReleased()
+			if err := admin.serve(func() error { return udpEcho.Serve(udpEchoConn) }); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	for port, scheme := range portScheme {
 		m := &nqserver.Server{
-			PublicHostPort: hostPort,
-			PublicPort:     port,
-			EnableCORS:     *enableCORS,
-			ContextPath:    *contextPath,
-			Scheme:         scheme,
+			PublicHostPort:             publicHostPort(port),
+			PublicPort:                 port,
+			EnableCORS:                 *enableCORS,
+			ContextPath:                *contextPath,
+			Scheme:                     scheme,
+			EnableMPTCP:                *enableMPTCP,
+			Capabilities:               capabilities,
+			CongestionControlEndpoints: ccEndpoints,
+			HTTP1Endpoint:              http1Endpoint,
+			DSCPMarkings:               dscpMarkings,
+			EnableResults:              results != nil,
+			Sessions:                   sessions,
+			EnableWebSocket:            *enableWebSocket,
+			UDPEchoHostPort:            udpEchoHostPort,
 		}
 
-		if *debug {
-			go m.PrintStats()
-		}
+		admin.addServer(m)
 
-		if scheme == "https" && *enableHTTP3 {
+		congestionControl, dedicated := portCongestionControl[port]
+		if !dedicated {
+			congestionControl = l4sAlgorithm
+		}
+		control := controlFor(congestionControl)
+		listenConfig := net.ListenConfig{Control: control}
+		listenConfig.SetMultipathTCP(*enableMPTCP)
+
+		// HTTP/3 would bypass the TCP congestion control a dedicated port is
+		// there to measure.
+		http1Only := port == *http1Port
+		serveH3 := scheme == "https" && *enableHTTP3 && !dedicated && !http1Only
+		if serveH3 {
 			m.EnableH3AltSvc = true
 		}
 
-		mux := http.NewServeMux()
-		mux.HandleFunc(m.ContextPath+"/", m.ConfigHandler)       // NOTE: This will go away
-		mux.HandleFunc(m.ContextPath+"/config", m.ConfigHandler) // NOTE: This will go away
-		mux.HandleFunc(m.ContextPath+"/.well-known/nq", m.ConfigHandler)
-		for pattern, handler := range nqserver.CountingBulkHandlers(m.ContextPath, *enableCORS, &m.BytesServed, &m.BytesReceived) {
-			mux.HandleFunc(pattern, handler)
+		switch {
+		case http1Only:
+			m.Protocols = []string{"http/1.1"}
+		case scheme == "http" && *enableH2C:
+			m.Protocols = []string{"h2c"}
+		case scheme == "https" && *enableHTTP2:
+			m.Protocols = []string{"h2"}
+		default:
+			m.Protocols = []string{"http/1.1"}
+		}
+		if serveH3 {
+			m.Protocols = append(m.Protocols, "h3")
 		}
 
-		var nl net.Listener
-		var err error
+		// The WebTransport server serves HTTP/3 too, upgrading the
+		// requests of its handlers.
+		var wt *webtransport.Server
+		if serveH3 && *enableWebTransport {
+			wt = &webtransport.Server{}
+			m.EnableWebTransport = true
+		}
 
-		listenConfig := net.ListenConfig{
-			Control: func(network, address string, conn syscall.RawConn) error {
-				if *socketSendBuffer > 0 {
-					log.Printf("setting TCP_NOTSENT_LOWAT to %d", *socketSendBuffer)
-					if err := setTCPNotSentLowat(conn, int(*socketSendBuffer)); err != nil {
-						return err
-					}
-				}
+		var rawQUIC *nqserver.RawQUICServer
+		if serveH3 && *enableRawQUIC {
+			rawQUIC = &nqserver.RawQUICServer{
+				BytesServed:   &m.BytesServed,
+				BytesReceived: &m.BytesReceived,
+			}
+			m.EnableRawQUIC = true
+		}
 
-				if *enableL4s || *enableL4sAlgorithm != "" {
-					actualL4SCongestionControlAlgorithm := defaultL4SCongestionControlAlgorithm
-					if *enableL4sAlgorithm != "" {
-						actualL4SCongestionControlAlgorithm = *enableL4sAlgorithm
-					}
-					log.Printf("setting TCP_CONGESTION to %v", actualL4SCongestionControlAlgorithm)
-					if err := setTCPL4S(conn, actualL4SCongestionControlAlgorithm); err != nil {
-						return err
-					}
+		mux := http.NewServeMux()
+		// New tests are turned away while draining.
+		configHandler := admin.admit(http.HandlerFunc(m.ConfigHandler))
+		if *enableWebUI {
+			mux.Handle(m.ContextPath+"/", withWebUIRedirect(m.ContextPath, configHandler)) // NOTE: This will go away
+			mux.Handle(m.ContextPath+"/ui/", nqserver.WebUIHandler(m.ContextPath))
+		} else {
+			mux.Handle(m.ContextPath+"/", configHandler) // NOTE: This will go away
+		}
+		mux.Handle(m.ContextPath+"/config", configHandler) // NOTE: This will go away
+		mux.Handle(m.ContextPath+"/.well-known/nq", configHandler)
+		if results != nil {
+			mux.Handle(m.ContextPath+"/results", results.SubmitHandler(*enableCORS))
+		}
+		for pattern, handler := range nqserver.CountingBulkHandlers(m.ContextPath, *enableCORS, &m.BytesServed, &m.BytesReceived) {
+			var h http.Handler = handler
+			if *enablePacingRate && http1Only {
+				h = withPacingRate(h, pacingRate)
+			}
+			if *enableDSCP && http1Only {
+				h = withDSCP(h, int(tos))
+			}
+			if isBulkPattern(pattern) {
+				h = admin.countBulk(h)
+			}
+			if sessions != nil {
+				h = sessions.Handler(path.Base(pattern), h)
+			}
+			if statsd != nil {
+				h = withStatsD(statsd, pattern, h)
+			}
+			if tel != nil {
+				h = tel.handler(pattern, h)
+			}
+			mux.Handle(pattern, h)
+		}
+		// WebSockets take over the connection, so the handlers can't be
+		// wrapped by those needing the response, such as sessions'.
+		if *enableWebSocket {
+			for pattern, handler := range nqserver.CountingWebSocketHandlers(m.ContextPath, *enableCORS, &m.BytesServed, &m.BytesReceived) {
+				h := handler
+				if *enablePacingRate && http1Only {
+					h = withPacingRate(h, pacingRate)
 				}
-
-				if tos > 0 {
-					log.Printf("Setting IP_TOS to %d", tos)
-					if err := setIPTos(network, conn, int(tos)); err != nil {
-						return err
-					}
+				if *enableDSCP && http1Only {
+					h = withDSCP(h, int(tos))
+				}
+				if isBulkPattern(pattern) {
+					h = admin.countBulk(h)
 				}
-				return nil
-			},
+				mux.Handle(pattern, h)
+			}
+		}
+		if wt != nil {
+			for pattern, handler := range nqserver.CountingWebTransportHandlers(m.ContextPath, *enableCORS, wt, &m.BytesServed, &m.BytesReceived) {
+				mux.Handle(pattern, admin.countBulk(handler))
+			}
 		}
 
-		nl, err = listenConfig.Listen(operatingCtx, "tcp", fmt.Sprintf("%s:%d", *listenAddr, port))
-		if err != nil {
-			log.Fatal(err)
+		log.Printf("Network Quality URL: %s://%s:%d%s/.well-known/nq", scheme, *configName, port, *contextPath)
+
+		// Connections are tracked for the admin interface.
+		handler := conns.handler(port, mux)
+		connContext := func(ctx context.Context, c net.Conn) context.Context {
+			return conns.connContext(m.ConnContext(ctx, c), c)
 		}
 
-		if scheme == "https" {
-			nl = tls.NewListener(nl, cfg)
+		// The acceptors of a port share its WebTransport server, whose
+		// HTTP/3 server must only be set up once.
+		var wtServer *webTransportServer
+		if wt != nil {
+			wt.H3 = http3.Server{
+				Handler: countInFlight(&h3Requests, handler),
+				Addr:    fmt.Sprintf("%s:%d", *listenAddr, port),
+			}
+			wtServer = &webTransportServer{Server: wt}
+			mut.Lock()
+			h3Servers = append(h3Servers, wtServer)
+			mut.Unlock()
 		}
 
-		mynl := nl
+		portTLSConfig := cfg
+		if http1Only && cfg != nil {
+			portTLSConfig = http1TLSConfig(cfg)
+		}
 
-		log.Printf("Network Quality URL: %s://%s:%d%s/.well-known/nq", scheme, *configName, port, *contextPath)
+		// Each acceptor gets its own sockets and servers; with SO_REUSEPORT
+		// the kernel spreads incoming connections across them.
+		for i := 0; i < *acceptors; i++ {
+			var nl net.Listener
+			var err error
 
-		go func(scheme string, nl net.Listener, port int) {
-			if *enableH2C {
-				server := &http.Server{
-					Handler:           h2c.NewHandler(mux, &http2.Server{}),
-					ReadHeaderTimeout: 3 * time.Second,
-				}
-				mut.Lock()
-				servers = append(servers, server)
-				mut.Unlock()
-				if err := server.Serve(nl); err != nil {
+			if nl = activated.listener(port); nl != nil {
+				log.Printf("Using inherited listener on %s", nl.Addr())
+				if err := controlSocket(nl.(syscall.Conn), nl.Addr(), control); err != nil {
 					log.Fatal(err)
 				}
-				wg.Done()
 			} else {
-				if scheme == "https" {
-					if *enableHTTP3 {
-						log.Printf("Enabling H3 on %q", fmt.Sprintf("%s:%d", *listenAddr, port))
-						server := http3.Server{
-							Handler:    mux,
-							Addr:       fmt.Sprintf("%s:%d", *listenAddr, port),
-							QuicConfig: &quic.Config{},
-						}
-						// No Shutdown(...) available for http3.Server
+				nl, err = listenConfig.Listen(operatingCtx, "tcp", fmt.Sprintf("%s:%d", *listenAddr, port))
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
 
-						go func() {
-							if err := server.ListenAndServeTLS(*certFilename, *keyFilename); !errors.Is(err, http.ErrServerClosed) {
-								log.Fatal(err)
-							}
-							wg.Done()
-						}()
-					}
+			handoffListeners = append(handoffListeners, nl)
+			admin.listeners.Add(1)
 
-					server := &http.Server{
-						Handler:           mux,
-						ReadHeaderTimeout: 3 * time.Second,
-					}
+			if congestionControl != "" {
+				nl = &ecnListener{Listener: nl, m: m, congestionControl: congestionControl, debug: *debug}
+			}
+			nl = conns.listener(nl, port, scheme)
 
-					if *enableHTTP2 {
-						log.Printf("Enabling H2 on %q", fmt.Sprintf("%s:%d", *listenAddr, port))
-						if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
-							log.Fatal(err)
-						}
-					}
-					mut.Lock()
-					servers = append(servers, server)
-					mut.Unlock()
+			if scheme == "https" {
+				nl = tls.NewListener(nl, portTLSConfig)
+			}
 
-					if err := server.Serve(nl); !errors.Is(err, http.ErrServerClosed) {
-						log.Fatalf("FATAL: %q", err)
-					}
+			// The H3 server shares the port number, but needs its own UDP socket.
+			var pc net.PacketConn
+			if serveH3 {
+				if pc = activated.packetConn(port); pc != nil {
+					log.Printf("Using inherited UDP socket on %s", pc.LocalAddr())
 				} else {
+					pc, err = packetListenConfig.ListenPacket(operatingCtx, "udp", fmt.Sprintf("%s:%d", *listenAddr, port))
+					if err != nil {
+						log.Fatal(err)
+					}
+				}
+				handoffPacketConns = append(handoffPacketConns, pc)
+				admin.listeners.Add(1)
+
+				// QUIC packets aren't marked ECT(1) with -enable-l4s: that
+				// is reserved for scalable congestion control (RFC 9331),
+				// which quic-go's isn't.
+				pc = newAcceptorPacketConn(pc, i)
+				wg.Add(1)
+			}
+
+			mynl := nl
+
+			wg.Add(1)
+			go func(scheme string, nl net.Listener, pc net.PacketConn, port int) {
+				if *enableH2C && !http1Only {
 					server := &http.Server{
-						Handler:           mux,
+						Handler:           h2c.NewHandler(handler, &http2.Server{}),
 						ReadHeaderTimeout: 3 * time.Second,
+						ConnContext:       connContext,
+						ConnState:         conns.connState,
 					}
 					mut.Lock()
 					servers = append(servers, server)
 					mut.Unlock()
-					if err := server.Serve(nl); !errors.Is(err, http.ErrServerClosed) {
-						log.Fatalf("FATAL: %q", err)
+					if err := admin.serve(func() error { return server.Serve(nl) }); !errors.Is(err, http.ErrServerClosed) {
+						log.Fatal(err)
 					}
-				}
-			}
-			wg.Done()
-		}(scheme, mynl, port)
+				} else {
+					if scheme == "https" {
+						if pc != nil {
+							log.Printf("Enabling H3 on %q", fmt.Sprintf("%s:%d", *listenAddr, port))
+							var server h3Server
+							if wtServer != nil {
+								server = wtServer
+							} else {
+								server = &http3.Server{
+									Handler: countInFlight(&h3Requests, handler),
+									Addr:    fmt.Sprintf("%s:%d", *listenAddr, port),
+								}
+								// No Shutdown(...) available for http3.Server
+								mut.Lock()
+								h3Servers = append(h3Servers, server)
+								mut.Unlock()
+							}
 
-		// Setup announcer for https configuration port
-		if *announce && scheme == "https" {
-			announceResponder, announceHandle, err := configureAnnouncer(ips, *announceName, port)
-			if err != nil {
-				log.Fatalf("Could not announce the server instance: %v", err)
-			}
+							go func() {
+								// A parent we are upgrading from may still be
+								// serving QUIC connections on this socket.
+								activated.waitReleased()
+								tlsConfig := http3.ConfigureTLSConfig(cfg)
+								if rawQUIC != nil {
+									tlsConfig = nqserver.RawQUICTLSConfig(cfg)
+								}
+								ln, err := quic.ListenEarly(pc, tlsConfig, &quic.Config{Tracer: conns.quicTracer, EnableDatagrams: wt != nil || rawQUIC != nil})
+								if err != nil {
+									log.Fatal(err)
+								}
+								h3ln := conns.quicListener(quicGate.listener(ln), port)
+								if rawQUIC != nil {
+									h3ln = rawQUIC.Listener(h3ln)
+								}
+								if err := admin.serve(func() error { return server.ServeListener(h3ln) }); !errors.Is(err, http.ErrServerClosed) {
+									log.Fatal(err)
+								}
+								wg.Done()
+							}()
+						}
 
-			go func() {
-				if err := announceResponder.Respond(operatingCtx); err != nil {
-					log.Fatal(err)
+						server := &http.Server{
+							Handler:           handler,
+							ReadHeaderTimeout: 3 * time.Second,
+							ConnContext:       connContext,
+							ConnState:         conns.connState,
+						}
+
+						if *enableHTTP2 && !http1Only {
+							log.Printf("Enabling H2 on %q", fmt.Sprintf("%s:%d", *listenAddr, port))
+							if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+								log.Fatal(err)
+							}
+						}
+						mut.Lock()
+						servers = append(servers, server)
+						mut.Unlock()
+
+						if err := admin.serve(func() error { return server.Serve(nl) }); !errors.Is(err, http.ErrServerClosed) {
+							log.Fatalf("FATAL: %q", err)
+						}
+					} else {
+						server := &http.Server{
+							Handler:           handler,
+							ReadHeaderTimeout: 3 * time.Second,
+							ConnContext:       connContext,
+							ConnState:         conns.connState,
+						}
+						mut.Lock()
+						servers = append(servers, server)
+						mut.Unlock()
+						if err := admin.serve(func() error { return server.Serve(nl) }); !errors.Is(err, http.ErrServerClosed) {
+							log.Fatalf("FATAL: %q", err)
+						}
+					}
 				}
-			}()
+				wg.Done()
+			}(scheme, mynl, pc, port)
+		}
 
-			announceShutdowners = append(announceShutdowners, func() { announceResponder.Remove(announceHandle) })
+		if announced[port] {
+			name := *announceName
+			if port != primaryPort {
+				name = fmt.Sprintf("%s (%s %d)", *announceName, scheme, port)
+			}
+			ann := announcement{
+				name:     name,
+				port:     port,
+				text:     m.TXTRecord(),
+				subtypes: protocolSubtypes(m.Protocols),
+			}
+			if announcer != nil {
+				if err := announcer.add(ann); err != nil {
+					log.Fatalf("Could not announce the server instance: %v", err)
+				}
+			}
+			if updater != nil {
+				updater.add(ann)
+			}
 		}
 	}
 
+	activated.closeUnused()
+	activated.notifyReady()
+	go conns.run(operatingCtx)
+	// Sessions still active at exit are finished once the servers are
+	// done with them.
+	sessionsCtx, stopSessions := context.WithCancel(context.Background())
+	sessionsDone := make(chan struct{})
+	if sessions != nil {
+		go func() {
+			sessions.Run(sessionsCtx)
+			close(sessionsDone)
+		}()
+	} else {
+		close(sessionsDone)
+	}
+	admin.ready.Store(true)
+	admin.setDebugStats(*debug)
+	go admin.monitorSendRate()
+	if statsd != nil {
+		statsSinks = append(statsSinks, statsDGauges{client: statsd, admin: admin, conns: conns})
+	}
+	if len(statsSinks) > 0 {
+		go nqserver.NewStatsReporter(admin.measurementServers(), *statsInterval, statsSinks...).Run(operatingCtx)
+	}
+
+	if announcer != nil {
+		go func() {
+			if err := announcer.run(operatingCtx); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if updater != nil {
+		go updater.run(operatingCtx)
+	}
+
 	// The user can stop the server with SIGINT
 	signalChannel := make(chan os.Signal, 1)   // make the channel buffered, per documentation.
 	signal.Notify(signalChannel, os.Interrupt) // only Interrupt is guaranteed to exist on all platforms.
 
-	<-signalChannel
+	// SIGUSR2 hands the listeners to a new copy of the binary.
+	upgradeChannel := make(chan os.Signal, 1)
+	notifyUpgrade(upgradeChannel)
 
-	for _, server := range servers {
-		if err := server.Shutdown(operatingCtx); err != nil {
+	shutdownCtx := operatingCtx
+	var u *upgrade
+waitForSignal:
+	for {
+		select {
+		case <-signalChannel:
+			break waitForSignal
+		case <-upgradeChannel:
+			log.Printf("Upgrade requested, starting new process")
+			if u, err = startUpgrade(handoffListeners, handoffPacketConns, upgradeReadyTimeout); err != nil {
+				log.Printf("Upgrade failed: %v", err)
+				continue
+			}
+
+			var cancel context.CancelFunc
+			shutdownCtx, cancel = context.WithTimeout(operatingCtx, *upgradeDrainTimeout)
+			defer cancel()
+			log.Printf("Draining in-flight transfers for up to %s", *upgradeDrainTimeout)
+			break waitForSignal
+		}
+	}
+
+	// Tell load balancers to stop sending us new clients.
+	admin.ready.Store(false)
+
+	// Turn away new QUIC connections, as Shutdown does TCP ones below. After
+	// an upgrade, clients retry them once the UDP sockets are released.
+	quicGate.close()
+
+	mut.Lock()
+	httpServers := append([]*http.Server(nil), servers...)
+	quicServers := append([]h3Server(nil), h3Servers...)
+	mut.Unlock()
+
+	var shutdownWg sync.WaitGroup
+	for _, server := range httpServers {
+		shutdownWg.Add(1)
+		go func(server *http.Server) {
+			defer shutdownWg.Done()
+			if err := server.Shutdown(shutdownCtx); err != nil {
+				log.Printf("error shutting down: %s", err)
+				server.Close()
+			}
+		}(server)
+	}
+
+	// http3.Server can't shut down gracefully, so wait for the in-flight
+	// requests ourselves before closing it.
+	waitInFlight(shutdownCtx, &h3Requests)
+	for _, server := range quicServers {
+		if err := server.Close(); err != nil {
 			log.Printf("error shutting down: %s", err)
 		}
 	}
 
+	if udpEchoConn != nil {
+		udpEchoConn.Close()
+	}
+
+	// We no longer read from the UDP sockets, so the new process can take
+	// them over while the TCP transfers finish.
+	if u != nil {
+		u.releaseUDP()
+	}
+
+	shutdownWg.Wait()
 	wg.Wait()
+	stopSessions()
+	<-sessionsDone
 
-	if *announce {
+	if adminHTTPServer != nil {
+		adminHTTPServer.Close()
+	}
+
+	if tel != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		tel.shutdown(ctx)
+		cancel()
+	}
+
+	if u != nil {
+		// The new process announces the same service, so leave the
+		// announcements and DNS registrations in place rather than sending
+		// goodbyes.
+		log.Printf("Upgrade complete, exiting")
+		return
+	}
+
+	if announcer != nil || updater != nil {
 		log.Printf("Shutting down dnssd announcer")
 		shutdownDone := make(chan interface{})
 		go func() {
-			for _, shutdowner := range announceShutdowners {
-				shutdowner()
+			if announcer != nil {
+				announcer.remove()
+			}
+			if updater != nil {
+				updater.remove()
 			}
 			shutdownDone <- nil
 		}()
@@ -418,3 +1085,19 @@ func main() {
 		}
 	}
 }
+
+// publicHostPort returns the host[:port] clients use to reach port.
+func publicHostPort(port int) string {
+	if port == 80 || port == 443 {
+		return *publicName
+	}
+	return fmt.Sprintf("%s:%d", *publicName, port)
+}
+
+// http1TLSConfig returns cfg for -http1-port, whose clients can't negotiate
+// HTTP/2.
+func http1TLSConfig(cfg *tls.Config) *tls.Config {
+	cfg = cfg.Clone()
+	cfg.NextProtos = []string{"http/1.1"}
+	return cfg
+}
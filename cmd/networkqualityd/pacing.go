@@ -0,0 +1,103 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+// parseBitRate parses a rate in bits per second, optionally with a k, M or
+// G suffix (powers of 1000), and returns it in bytes per second as used by
+// SO_MAX_PACING_RATE.
+func parseBitRate(value string) (uint64, error) {
+	multiplier := uint64(1)
+	number := value
+	switch {
+	case strings.HasSuffix(value, "k"):
+		multiplier, number = 1000, strings.TrimSuffix(value, "k")
+	case strings.HasSuffix(value, "M"):
+		multiplier, number = 1000*1000, strings.TrimSuffix(value, "M")
+	case strings.HasSuffix(value, "G"):
+		multiplier, number = 1000*1000*1000, strings.TrimSuffix(value, "G")
+	}
+
+	rate, err := strconv.ParseFloat(number, 64)
+	rate *= float64(multiplier)
+	if err != nil || !(rate >= 8 && rate <= 1e15) {
+		return 0, fmt.Errorf("invalid rate %q", value)
+	}
+	return uint64(rate / 8), nil
+}
+
+// warnUnlessFQ points out that pacing works best with the fq qdisc. Without
+// it the kernel falls back to TCP internal pacing, which costs more CPU.
+func warnUnlessFQ() {
+	qdisc, err := os.ReadFile("/proc/sys/net/core/default_qdisc")
+	if err != nil {
+		return
+	}
+	if name := strings.TrimSpace(string(qdisc)); name != "fq" {
+		log.Printf("default qdisc is %s, not fq; pacing will use TCP internal pacing", name)
+	}
+}
+
+// withPacingRate applies the maximum pacing rate requested with
+// nqserver.PacingRateParameter to the connection serving the request while h
+// serves it. Like the DSCP marking, it is only applied to HTTP/1.1
+// connections, those of -http1-port, and limit, the rate every connection
+// starts with if set, is put back afterwards; connections where that fails
+// are closed. Requests can't raise the rate above limit.
+func withPacingRate(h http.Handler, limit uint64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.URL.Query().Get(nqserver.PacingRateParameter)
+		if len(value) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		rate, err := parseBitRate(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if limit > 0 && rate > limit {
+			rate = limit
+		}
+
+		tcpConn, ok := nqserver.TCPConnFromContext(r.Context())
+		if !ok || r.ProtoMajor != 1 {
+			http.Error(w, "pacing is only supported over HTTP/1.1", http.StatusNotImplemented)
+			return
+		}
+
+		rawConn, err := tcpConn.SyscallConn()
+		if err == nil {
+			err = setMaxPacingRate(rawConn, rate)
+		}
+		if err != nil {
+			log.Printf("could not set pacing rate %s for %s: %v", value, r.RemoteAddr, err)
+			http.Error(w, fmt.Sprintf("could not set pacing rate %s", value), http.StatusInternalServerError)
+			return
+		}
+		// All ones is the kernel's default: no limit.
+		if limit == 0 {
+			limit = math.MaxUint64
+		}
+		defer func() {
+			if err := setMaxPacingRate(rawConn, limit); err != nil {
+				log.Printf("could not restore pacing rate for %s, closing the connection: %v", r.RemoteAddr, err)
+				closeAfterResponse(w, tcpConn)
+			}
+		}()
+
+		h.ServeHTTP(w, r)
+	})
+}
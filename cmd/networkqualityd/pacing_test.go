@@ -0,0 +1,86 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"runtime"
+	"testing"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+func TestParseBitRate(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    uint64
+		wantErr bool
+	}{
+		{value: "8", want: 1},
+		{value: "800", want: 100},
+		{value: "10k", want: 1250},
+		{value: "50M", want: 6250000},
+		{value: "2.5M", want: 312500},
+		{value: "1G", want: 125000000},
+		{value: "1000G", want: 125000000000},
+		{value: "1000000G", want: 125000000000000},
+		{value: "1000001G", wantErr: true},
+		{value: "7", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-50M", wantErr: true},
+		{value: "50m", wantErr: true},
+		{value: "M", wantErr: true},
+		{value: "NaN", wantErr: true},
+		{value: "Inf", wantErr: true},
+		{value: "", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseBitRate(test.value)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseBitRate(%q) error = %v, want error %t", test.value, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("parseBitRate(%q) = %d, want %d", test.value, got, test.want)
+		}
+	}
+}
+
+func TestPacingRateURLs(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_MAX_PACING_RATE is Linux only")
+	}
+	m := &nqserver.Server{Scheme: "https"}
+	s := startHTTP1Port(t, m, func(h http.Handler) http.Handler { return withPacingRate(h, 0) })
+	client := s.Client()
+
+	var config struct {
+		HTTP1URLs struct {
+			SmallDownloadURL string `json:"small_download_url"`
+		} `json:"http1_urls"`
+	}
+	fetchConfig(t, client, s.URL, &config)
+
+	tests := []struct {
+		rate string
+		want int
+	}{
+		{"10M", http.StatusOK},
+		{"1G", http.StatusOK},
+		{"fast", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		u := config.HTTP1URLs.SmallDownloadURL + "?" + nqserver.PacingRateParameter + "=" + test.rate
+		resp, err := client.Get(u)
+		if err != nil {
+			t.Errorf("GET %s: %v", u, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != test.want || resp.ProtoMajor != 1 {
+			t.Errorf("GET %s = %s over %s, want %d over HTTP/1.1", u, resp.Status, resp.Proto, test.want)
+		}
+	}
+}
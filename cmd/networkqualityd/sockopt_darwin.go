@@ -12,3 +12,15 @@ import (
 func setTCPL4S(syscall.RawConn, string) error {
 	return errUnsupportedPlatform
 }
+
+func setMaxPacingRate(syscall.RawConn, uint64) error {
+	return errUnsupportedPlatform
+}
+
+func getTCPCongestion(syscall.RawConn) (string, error) {
+	return "", errUnsupportedPlatform
+}
+
+func getTCPECNInfo(syscall.RawConn) (tcpECNInfo, error) {
+	return tcpECNInfo{}, errUnsupportedPlatform
+}
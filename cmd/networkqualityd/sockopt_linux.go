@@ -6,6 +6,8 @@
 package main
 
 import (
+	"math"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -20,3 +22,57 @@ func setTCPL4S(conn syscall.RawConn, value string) error {
 	}
 	return setsockoptErr
 }
+
+// setMaxPacingRate caps the rate, in bytes per second, at which the kernel
+// (TCP internal pacing or the fq qdisc) sends on the socket.
+func setMaxPacingRate(conn syscall.RawConn, value uint64) error {
+	var setsockoptErr error
+	if err := conn.Control(func(fd uintptr) {
+		// Kernels before 4.20 only take 32 bit rates.
+		if value <= math.MaxInt32 {
+			setsockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, int(value))
+		} else {
+			setsockoptErr = unix.SetsockoptUint64(int(fd), unix.SOL_SOCKET, unix.SO_MAX_PACING_RATE, value)
+		}
+	}); err != nil {
+		return err
+	}
+	return setsockoptErr
+}
+
+func getTCPCongestion(conn syscall.RawConn) (string, error) {
+	var value string
+	var getsockoptErr error
+	if err := conn.Control(func(fd uintptr) {
+		value, getsockoptErr = unix.GetsockoptString(int(fd), unix.IPPROTO_TCP, unix.TCP_CONGESTION)
+	}); err != nil {
+		return "", err
+	}
+	// The kernel pads the name to TCP_CA_NAME_MAX.
+	return strings.TrimRight(value, "\x00"), getsockoptErr
+}
+
+// Bits of tcpi_options (see include/uapi/linux/tcp.h).
+const (
+	tcpiOptECN     = 8
+	tcpiOptECNSeen = 16
+)
+
+func getTCPECNInfo(conn syscall.RawConn) (tcpECNInfo, error) {
+	var info *unix.TCPInfo
+	var getsockoptErr error
+	if err := conn.Control(func(fd uintptr) {
+		info, getsockoptErr = unix.GetsockoptTCPInfo(int(fd), unix.IPPROTO_TCP, unix.TCP_INFO)
+	}); err != nil {
+		return tcpECNInfo{}, err
+	}
+	if getsockoptErr != nil {
+		return tcpECNInfo{}, getsockoptErr
+	}
+
+	return tcpECNInfo{
+		Negotiated:  info.Options&tcpiOptECN != 0,
+		Seen:        info.Options&tcpiOptECNSeen != 0,
+		DeliveredCE: info.Delivered_ce,
+	}, nil
+}
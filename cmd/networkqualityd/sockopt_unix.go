@@ -6,6 +6,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strings"
@@ -24,17 +25,32 @@ func setTCPNotSentLowat(conn syscall.RawConn, value int) error {
 	return setsockoptErr
 }
 
+func setReusePort(conn syscall.RawConn) error {
+	var setsockoptErr error
+	if err := conn.Control(func(fd uintptr) {
+		setsockoptErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	}); err != nil {
+		return err
+	}
+	return setsockoptErr
+}
+
 func setIPTos(network string, conn syscall.RawConn, value int) error {
 	var setsockoptErr error
 	if err := conn.Control(func(fd uintptr) {
 		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, value); err != nil {
-			log.Fatalf("failed to configure IP_TOS: %v", os.NewSyscallError("setsockopt", err))
+			setsockoptErr = fmt.Errorf("failed to configure IP_TOS: %w", os.NewSyscallError("setsockopt", err))
+			return
 		}
 		if strings.HasSuffix(network, "4") {
 			return
 		}
 
 		if err := unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, value); err != nil {
+			if strings.HasSuffix(network, "6") {
+				setsockoptErr = fmt.Errorf("failed to configure IPV6_TCLASS: %w", os.NewSyscallError("setsockopt", err))
+				return
+			}
 			log.Printf("Error setting IPV6_TCLASS: %v", os.NewSyscallError("setsockopt", err))
 		}
 	}); err != nil {
@@ -17,6 +17,22 @@ func setTCPL4S(conn syscall.RawConn, value string) error {
 	return errUnsupportedPlatform
 }
 
+func setReusePort(conn syscall.RawConn) error {
+	return errUnsupportedPlatform
+}
+
 func setIPTos(network string, conn syscall.RawConn, value int) error {
 	return errUnsupportedPlatform
 }
+
+func setMaxPacingRate(conn syscall.RawConn, value uint64) error {
+	return errUnsupportedPlatform
+}
+
+func getTCPCongestion(conn syscall.RawConn) (string, error) {
+	return "", errUnsupportedPlatform
+}
+
+func getTCPECNInfo(conn syscall.RawConn) (tcpECNInfo, error) {
+	return tcpECNInfo{}, errUnsupportedPlatform
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+// withStatsD returns a handler sending a requests counter and a
+// request_duration timer for each of h's requests, which are for pattern,
+// tagged with the handler and protocol.
+func withStatsD(client *nqserver.StatsDClient, pattern string, h http.Handler) http.Handler {
+	handler := "handler:" + path.Base(pattern)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		cw := nqserver.NewCountingResponseWriter(w)
+		h.ServeHTTP(cw, r)
+
+		protocol := "protocol:" + nqserver.ProtocolName(r)
+		client.Count("requests", 1, handler, protocol, "status:"+strconv.Itoa(cw.Status))
+		client.Timing("request_duration", time.Since(start), handler, protocol)
+	})
+}
+
+// statsDGauges is a stats sink sending gauges of the work in progress.
+type statsDGauges struct {
+	client *nqserver.StatsDClient
+	admin  *adminServer
+	conns  *connTracker
+}
+
+func (s statsDGauges) Report(nqserver.StatsReport) error {
+	s.client.Gauge("bulk_transfers_in_flight", float64(s.admin.bulkStreams.Load()))
+	s.client.Gauge("open_connections", float64(s.conns.len()))
+	return nil
+}
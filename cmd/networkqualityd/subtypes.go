@@ -0,0 +1,203 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/dnssd"
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// A subtypeResponder answers multicast DNS queries for service subtypes
+// (RFC 6763 7.1), which dnssd doesn't support. Everything else about the
+// instances, including their SRV and TXT records, is left to dnssd.
+//
+// Our sockets share the mDNS port with dnssd's; both see every query.
+type subtypeResponder struct {
+	mut        sync.Mutex
+	ptrs       map[string][]string
+	interfaces []string
+
+	ipv4 *ipv4.PacketConn
+	ipv6 *ipv6.PacketConn
+}
+
+// set replaces the subtypes answered for with those of announcements, on
+// interfaces (or all of them if nil).
+func (r *subtypeResponder) set(announcements []announcement, interfaces []string) {
+	ptrs := make(map[string][]string)
+	for _, ann := range announcements {
+		for _, subtype := range ann.subtypes {
+			name := strings.ToLower(subtypeName(subtype, "local."))
+			ptrs[name] = append(ptrs[name], ann.instanceName("local."))
+		}
+	}
+
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	r.ptrs = ptrs
+	r.interfaces = interfaces
+}
+
+// run answers queries until ctx is done.
+func (r *subtypeResponder) run(ctx context.Context) error {
+	var errs []error
+
+	if conn, err := net.ListenUDP("udp4", dnssd.AddrIPv4LinkLocalMulticast); err != nil {
+		errs = append(errs, err)
+	} else {
+		r.ipv4 = ipv4.NewPacketConn(conn)
+		_ = r.ipv4.SetControlMessage(ipv4.FlagInterface, true)
+		_ = r.ipv4.SetMulticastLoopback(true)
+		for _, iface := range dnssd.MulticastInterfaces() {
+			_ = r.ipv4.JoinGroup(iface, &net.UDPAddr{IP: dnssd.IPv4LinkLocalMulticast})
+		}
+		go r.read(func(b []byte) (int, int, error) {
+			n, cm, _, err := r.ipv4.ReadFrom(b)
+			if cm == nil {
+				return n, 0, err
+			}
+			return n, cm.IfIndex, err
+		})
+	}
+
+	if conn, err := net.ListenUDP("udp6", dnssd.AddrIPv6LinkLocalMulticast); err != nil {
+		errs = append(errs, err)
+	} else {
+		r.ipv6 = ipv6.NewPacketConn(conn)
+		_ = r.ipv6.SetControlMessage(ipv6.FlagInterface, true)
+		_ = r.ipv6.SetMulticastLoopback(true)
+		for _, iface := range dnssd.MulticastInterfaces() {
+			_ = r.ipv6.JoinGroup(iface, &net.UDPAddr{IP: dnssd.IPv6LinkLocalMulticast})
+		}
+		go r.read(func(b []byte) (int, int, error) {
+			n, cm, _, err := r.ipv6.ReadFrom(b)
+			if cm == nil {
+				return n, 0, err
+			}
+			return n, cm.IfIndex, err
+		})
+	}
+
+	if r.ipv4 == nil && r.ipv6 == nil {
+		return errors.Join(errs...)
+	}
+
+	r.announce(dnssd.TTLDefault)
+
+	<-ctx.Done()
+	if r.ipv4 != nil {
+		r.ipv4.Close()
+	}
+	if r.ipv6 != nil {
+		r.ipv6.Close()
+	}
+	return nil
+}
+
+func (r *subtypeResponder) read(readFrom func([]byte) (int, int, error)) {
+	buf := make([]byte, 65536)
+	for {
+		n, ifIndex, err := readFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil || ifIndex == 0 {
+			continue
+		}
+
+		var query dns.Msg
+		if err := query.Unpack(buf[:n]); err != nil || query.Response {
+			continue
+		}
+
+		iface, err := net.InterfaceByIndex(ifIndex)
+		if err != nil {
+			continue
+		}
+
+		var answers []dns.RR
+		for _, q := range query.Question {
+			if q.Qtype == dns.TypePTR || q.Qtype == dns.TypeANY {
+				answers = append(answers, r.answers(q.Name, iface.Name, dnssd.TTLDefault)...)
+			}
+		}
+		if len(answers) > 0 {
+			r.send(answers, iface)
+		}
+	}
+}
+
+// answers returns the PTR records for the subtype name, if it is announced
+// on the named interface.
+func (r *subtypeResponder) answers(name, ifaceName string, ttl uint32) []dns.RR {
+	r.mut.Lock()
+	defer r.mut.Unlock()
+
+	if r.interfaces != nil && !contains(r.interfaces, ifaceName) {
+		return nil
+	}
+
+	var answers []dns.RR
+	for _, instance := range r.ptrs[strings.ToLower(name)] {
+		answers = append(answers, &dns.PTR{
+			Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+			Ptr: instance,
+		})
+	}
+	return answers
+}
+
+// announce sends all subtype records unsolicited, which with a zero ttl
+// withdraws them.
+func (r *subtypeResponder) announce(ttl uint32) {
+	r.mut.Lock()
+	var names []string
+	for name := range r.ptrs {
+		names = append(names, name)
+	}
+	r.mut.Unlock()
+
+	for _, iface := range dnssd.MulticastInterfaces() {
+		var answers []dns.RR
+		for _, name := range names {
+			answers = append(answers, r.answers(name, iface.Name, ttl)...)
+		}
+		if len(answers) > 0 {
+			r.send(answers, iface)
+		}
+	}
+}
+
+// goodbye withdraws the subtype records.
+func (r *subtypeResponder) goodbye() {
+	r.announce(0)
+	time.Sleep(250 * time.Millisecond)
+	r.announce(0)
+}
+
+// send multicasts a response with answers on iface.
+func (r *subtypeResponder) send(answers []dns.RR, iface *net.Interface) {
+	msg := &dns.Msg{Answer: answers}
+	msg.Response = true
+	msg.Authoritative = true
+	b, err := msg.Pack()
+	if err != nil {
+		return
+	}
+
+	if r.ipv4 != nil {
+		_, _ = r.ipv4.WriteTo(b, &ipv4.ControlMessage{IfIndex: iface.Index}, dnssd.AddrIPv4LinkLocalMulticast)
+	}
+	if r.ipv6 != nil {
+		_, _ = r.ipv6.WriteTo(b, &ipv6.ControlMessage{IfIndex: iface.Index}, dnssd.AddrIPv6LinkLocalMulticast)
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestSubtypeResponderAnswers(t *testing.T) {
+	var r subtypeResponder
+	r.set([]announcement{
+		{name: "nq-https", subtypes: []string{"_h2", "_h3"}},
+		{name: "nq-http", subtypes: []string{"_http1", "_h2c"}},
+		{name: "nq-cubic", subtypes: []string{"_h2"}},
+	}, []string{"eth0"})
+
+	tests := []struct {
+		name  string
+		iface string
+		want  []string
+	}{
+		{"_h2._sub._nq._tcp.local.", "eth0", []string{"nq-https._nq._tcp.local.", "nq-cubic._nq._tcp.local."}},
+		{"_H3._sub._nq._tcp.local.", "eth0", []string{"nq-https._nq._tcp.local."}},
+		{"_h2c._sub._nq._tcp.local.", "eth0", []string{"nq-http._nq._tcp.local."}},
+		{"_h2._sub._nq._tcp.local.", "wlan0", nil},
+		{"_quic._sub._nq._tcp.local.", "eth0", nil},
+		{"_nq._tcp.local.", "eth0", nil},
+	}
+	for _, test := range tests {
+		var got []string
+		for _, rr := range r.answers(test.name, test.iface, 120) {
+			if rr.Header().Name != test.name || rr.Header().Ttl != 120 {
+				t.Errorf("answers(%q, %q) has header %v", test.name, test.iface, rr.Header())
+			}
+			got = append(got, rr.(*dns.PTR).Ptr)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("answers(%q, %q) = %q, want %q", test.name, test.iface, got, test.want)
+		}
+	}
+}
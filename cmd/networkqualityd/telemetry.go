@@ -0,0 +1,257 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"sync/atomic"
+
+	nqserver "github.com/network-quality/goserver"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/propagation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName identifies our spans and metrics.
+const instrumentationName = "github.com/network-quality/goserver/cmd/networkqualityd"
+
+// Attributes of measurement request spans beyond the semantic conventions.
+const (
+	handlerKey       = attribute.Key("networkquality.handler")
+	bytesSentKey     = attribute.Key("networkquality.bytes_sent")
+	bytesReceivedKey = attribute.Key("networkquality.bytes_received")
+	clientPrefixKey  = attribute.Key("networkquality.client_prefix")
+	abortReasonKey   = attribute.Key("networkquality.abort_reason")
+)
+
+// telemetry exports a span for each measurement request, and the server
+// counters as metrics, to an OpenTelemetry collector over OTLP.
+type telemetry struct {
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+	tracer         trace.Tracer
+	propagator     propagation.TextMapPropagator
+}
+
+// newTelemetry starts exporting to the collector at endpoint (host:port)
+// using protocol, "grpc" or "http". The standard OTEL_EXPORTER_OTLP_*
+// environment variables apply too, e.g. for headers. Metrics are read
+// from the servers returned by servers.
+func newTelemetry(ctx context.Context, endpoint, protocol string, insecure bool, servers func() []*nqserver.Server) (*telemetry, error) {
+	var traceExporter sdktrace.SpanExporter
+	var metricExporter sdkmetric.Exporter
+	var err error
+
+	switch protocol {
+	case "grpc":
+		traceOptions := []otlptracegrpc.Option{otlptracegrpc.WithEndpoint(endpoint)}
+		metricOptions := []otlpmetricgrpc.Option{otlpmetricgrpc.WithEndpoint(endpoint)}
+		if insecure {
+			traceOptions = append(traceOptions, otlptracegrpc.WithInsecure())
+			metricOptions = append(metricOptions, otlpmetricgrpc.WithInsecure())
+		}
+		if traceExporter, err = otlptracegrpc.New(ctx, traceOptions...); err != nil {
+			return nil, err
+		}
+		if metricExporter, err = otlpmetricgrpc.New(ctx, metricOptions...); err != nil {
+			return nil, err
+		}
+	case "http":
+		traceOptions := []otlptracehttp.Option{otlptracehttp.WithEndpoint(endpoint)}
+		metricOptions := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(endpoint)}
+		if insecure {
+			traceOptions = append(traceOptions, otlptracehttp.WithInsecure())
+			metricOptions = append(metricOptions, otlpmetrichttp.WithInsecure())
+		}
+		if traceExporter, err = otlptracehttp.New(ctx, traceOptions...); err != nil {
+			return nil, err
+		}
+		if metricExporter, err = otlpmetrichttp.New(ctx, metricOptions...); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown OTLP protocol %q, must be grpc or http", protocol)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName("networkqualityd"),
+		semconv.ServiceVersion(nqserver.GitVersion),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &telemetry{
+		tracerProvider: sdktrace.NewTracerProvider(sdktrace.WithBatcher(traceExporter), sdktrace.WithResource(res)),
+		meterProvider:  sdkmetric.NewMeterProvider(sdkmetric.WithReader(sdkmetric.NewPeriodicReader(metricExporter)), sdkmetric.WithResource(res)),
+		propagator:     propagation.TraceContext{},
+	}
+	t.tracer = t.tracerProvider.Tracer(instrumentationName)
+
+	if err := t.observe(servers); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// observe reports the counters of each server as metrics.
+func (t *telemetry) observe(servers func() []*nqserver.Server) error {
+	meter := t.meterProvider.Meter(instrumentationName)
+
+	bytesServed, err := meter.Int64ObservableCounter("networkquality.bytes_served", metric.WithUnit("By"), metric.WithDescription("Bytes sent by the measurement handlers."))
+	if err != nil {
+		return err
+	}
+	bytesReceived, err := meter.Int64ObservableCounter("networkquality.bytes_received", metric.WithUnit("By"), metric.WithDescription("Bytes received by the measurement handlers."))
+	if err != nil {
+		return err
+	}
+	connections, err := meter.Int64ObservableCounter("networkquality.connections", metric.WithUnit("{connection}"), metric.WithDescription("Connections accepted."))
+	if err != nil {
+		return err
+	}
+
+	_, err = meter.RegisterCallback(func(_ context.Context, o metric.Observer) error {
+		for _, m := range servers() {
+			attrs := metric.WithAttributes(semconv.ServerPort(m.PublicPort), semconv.URLScheme(m.Scheme))
+			o.ObserveInt64(bytesServed, int64(atomic.LoadUint64(&m.BytesServed)), attrs)
+			o.ObserveInt64(bytesReceived, int64(atomic.LoadUint64(&m.BytesReceived)), attrs)
+			o.ObserveInt64(connections, int64(atomic.LoadUint64(&m.Connections)), attrs)
+		}
+		return nil
+	}, bytesServed, bytesReceived, connections)
+	return err
+}
+
+// shutdown exports what is left, giving up when ctx is done.
+func (t *telemetry) shutdown(ctx context.Context) {
+	if err := t.tracerProvider.Shutdown(ctx); err != nil {
+		log.Printf("could not export traces: %v", err)
+	}
+	if err := t.meterProvider.Shutdown(ctx); err != nil {
+		log.Printf("could not export metrics: %v", err)
+	}
+}
+
+// handler returns a handler recording a span for each of h's requests,
+// which are for pattern. Clients may pass a W3C traceparent header to
+// make it part of their own trace.
+func (t *telemetry) handler(pattern string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := t.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := t.tracer.Start(ctx, r.Method+" "+pattern,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(pattern),
+				semconv.NetworkProtocolName("http"),
+				semconv.NetworkProtocolVersion(protocolVersion(r)),
+				handlerKey.String(path.Base(pattern)),
+				clientPrefixKey.String(clientPrefix(r.RemoteAddr)),
+			))
+		defer span.End()
+
+		cw := nqserver.NewCountingResponseWriter(w)
+		var body *countingBody
+		if r.Body != nil {
+			body = &countingBody{ReadCloser: r.Body}
+			r.Body = body
+		}
+		h.ServeHTTP(cw, r.WithContext(ctx))
+
+		span.SetAttributes(
+			semconv.HTTPResponseStatusCode(cw.Status),
+			bytesSentKey.Int64(cw.Written),
+			bytesReceivedKey.Int64(body.count()),
+		)
+		if reason := abortReason(r, cw, body); len(reason) > 0 {
+			span.SetAttributes(abortReasonKey.String(reason))
+		}
+		if cw.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(cw.Status))
+		}
+	})
+}
+
+// abortReason returns why the transfer of a request ended early, or "" if
+// it didn't.
+func abortReason(r *http.Request, cw *nqserver.CountingResponseWriter, body *countingBody) string {
+	switch {
+	case cw.Err != nil:
+		return "write: " + cw.Err.Error()
+	case body != nil && body.err != nil && !errors.Is(body.err, io.EOF):
+		return "read: " + body.err.Error()
+	case r.Context().Err() != nil:
+		return "client went away"
+	}
+	return ""
+}
+
+// protocolVersion returns the HTTP version of r as in the
+// network.protocol.version attribute.
+func protocolVersion(r *http.Request) string {
+	if r.ProtoMajor == 1 {
+		return "1." + strconv.Itoa(r.ProtoMinor)
+	}
+	return strconv.Itoa(r.ProtoMajor)
+}
+
+// clientPrefix returns the /24 (IPv4) or /48 (IPv6) network of the client
+// at address, which identifies its network without identifying it.
+func clientPrefix(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return ""
+	case ip.To4() != nil:
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	default:
+		return (&net.IPNet{IP: ip.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+	}
+}
+
+// countingBody records the bytes read and the last error of a request
+// body.
+type countingBody struct {
+	io.ReadCloser
+	read int64
+	err  error
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil {
+		b.err = err
+	}
+	return n, err
+}
+
+func (b *countingBody) count() int64 {
+	if b == nil {
+		return 0
+	}
+	return b.read
+}
@@ -0,0 +1,70 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	nqserver "github.com/network-quality/goserver"
+)
+
+func TestClientPrefix(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.1:443", "192.0.2.0/24"},
+		{"192.0.2.255", "192.0.2.0/24"},
+		{"[2001:db8:1:2::1]:443", "2001:db8:1::/48"},
+		{"2001:db8:1:2::1", "2001:db8:1::/48"},
+		{"[::ffff:192.0.2.1]:443", "192.0.2.0/24"},
+		{"", ""},
+		{"example.com:443", ""},
+	}
+	for _, test := range tests {
+		if got := clientPrefix(test.address); got != test.want {
+			t.Errorf("clientPrefix(%q) = %q, want %q", test.address, got, test.want)
+		}
+	}
+}
+
+func TestAbortReason(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name     string
+		writeErr error
+		readErr  error
+		noBody   bool
+		ctx      context.Context
+		want     string
+	}{
+		{name: "complete", readErr: io.EOF, want: ""},
+		{name: "no body", noBody: true, want: ""},
+		{name: "write failed", writeErr: errors.New("broken pipe"), want: "write: broken pipe"},
+		{name: "read failed", readErr: io.ErrUnexpectedEOF, want: "read: unexpected EOF"},
+		{name: "write failed first", writeErr: errors.New("broken pipe"), readErr: io.ErrUnexpectedEOF, want: "write: broken pipe"},
+		{name: "client went away", readErr: io.EOF, ctx: canceled, want: "client went away"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/large", nil)
+		if test.ctx != nil {
+			r = r.WithContext(test.ctx)
+		}
+		cw := nqserver.NewCountingResponseWriter(httptest.NewRecorder())
+		cw.Err = test.writeErr
+		var body *countingBody
+		if !test.noBody {
+			body = &countingBody{err: test.readErr}
+		}
+		if got := abortReason(r, cw, body); got != test.want {
+			t.Errorf("%s: abortReason() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// upgradeParentEnv carries the pid of an upgrading networkqualityd to
+	// the process it starts; see activatedSocketsFromEnv.
+	upgradeParentEnv = "NETWORKQUALITYD_UPGRADE_PPID"
+
+	// upgradeReadyName and upgradeReleaseName name the pipes passed along
+	// with the sockets in LISTEN_FDNAMES.
+	upgradeReadyName   = "upgrade-ready"
+	upgradeReleaseName = "upgrade-release"
+
+	// upgradeReadyTimeout bounds how long the new process may take to start
+	// serving before the upgrade is abandoned.
+	upgradeReadyTimeout = 30 * time.Second
+)
+
+var errUpgradeNotReady = errors.New("new process exited before it was ready")
+
+// An upgrade is a copy of the running binary that was started with our
+// listening sockets, so that it can take over serving while we drain.
+type upgrade struct {
+	cmd     *exec.Cmd
+	release *os.File
+}
+
+// startUpgrade re-executes the current binary with the same arguments,
+// passing it the TCP listeners and UDP sockets, and waits up to timeout for
+// it to report that it is serving.
+func startUpgrade(listeners []net.Listener, packetConns []net.PacketConn, timeout time.Duration) (*upgrade, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, l := range listeners {
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %w", l.Addr(), err)
+		}
+		files = append(files, f)
+		names = append(names, "tcp")
+	}
+
+	for _, pc := range packetConns {
+		f, err := pc.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			return nil, fmt.Errorf("socket %s: %w", pc.LocalAddr(), err)
+		}
+		files = append(files, f)
+		names = append(names, "udp")
+	}
+
+	readyReader, readyWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer readyReader.Close()
+	files = append(files, readyWriter)
+	names = append(names, upgradeReadyName)
+
+	releaseReader, releaseWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	files = append(files, releaseReader)
+	names = append(names, upgradeReleaseName)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		upgradeParentEnv+"="+strconv.Itoa(os.Getpid()),
+	)
+
+	if err := cmd.Start(); err != nil {
+		releaseWriter.Close()
+		return nil, err
+	}
+
+	// Our copies of the child's pipe ends are closed by the deferred cleanup
+	// above, so a child that dies shows up as EOF on readyReader.
+	ready := make(chan error, 1)
+	go func() {
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(readyReader, b); err != nil {
+			ready <- errUpgradeNotReady
+			return
+		}
+		ready <- nil
+	}()
+
+	select {
+	case err = <-ready:
+	case <-time.After(timeout):
+		err = fmt.Errorf("new process not ready after %s", timeout)
+	}
+
+	if err != nil {
+		releaseWriter.Close()
+		if cmd.Process.Signal(syscall.SIGTERM) == nil {
+			_ = cmd.Wait()
+		}
+		return nil, err
+	}
+
+	log.Printf("Upgrade: pid %d is serving", cmd.Process.Pid)
+	return &upgrade{cmd: cmd, release: releaseWriter}, nil
+}
+
+// releaseUDP lets the new process start serving the UDP sockets. It must
+// only be called once we no longer read from them.
+func (u *upgrade) releaseUDP() {
+	if u.release != nil {
+		u.release.Close()
+		u.release = nil
+	}
+}
+
+// countInFlight keeps a count of the requests being served by h in n.
+func countInFlight(n *int64, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(n, 1)
+		defer atomic.AddInt64(n, -1)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// waitInFlight waits for the count maintained by countInFlight to drop to
+// zero, or for ctx to be done.
+func waitInFlight(ctx context.Context, n *int64) {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(n) > 0 {
+		select {
+		case <-ctx.Done():
+			log.Printf("%d requests still in flight", atomic.LoadInt64(n))
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// A quicAcceptGate stops the QUIC listeners it wraps from passing on new
+// connections once it is closed, turning them away instead. http3.Server
+// can't stop accepting without closing the connections it serves, unlike
+// http.Server.Shutdown.
+type quicAcceptGate struct {
+	closed atomic.Bool
+}
+
+// listener returns ln, gated by g.
+func (g *quicAcceptGate) listener(ln http3.QUICEarlyListener) http3.QUICEarlyListener {
+	return &gatedQUICListener{QUICEarlyListener: ln, g: g}
+}
+
+// close turns away the connections accepted from now on.
+func (g *quicAcceptGate) close() {
+	g.closed.Store(true)
+}
+
+type gatedQUICListener struct {
+	http3.QUICEarlyListener
+	g *quicAcceptGate
+}
+
+func (l *gatedQUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	for {
+		conn, err := l.QUICEarlyListener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !l.g.closed.Load() {
+			return conn, nil
+		}
+		conn.CloseWithError(quic.ApplicationErrorCode(http3.ErrCodeNoError), "shutting down")
+	}
+}
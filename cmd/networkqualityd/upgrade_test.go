@@ -0,0 +1,82 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+func TestQUICAcceptGate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Borrow the certificate of httptest, which is valid for 127.0.0.1.
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+	serverTLS := &tls.Config{Certificates: certServer.TLS.Certificates, NextProtos: []string{"nq-test"}}
+	clientTLS := &tls.Config{RootCAs: roots, NextProtos: []string{"nq-test"}}
+
+	ln, err := quic.ListenAddrEarly("127.0.0.1:0", serverTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	gate := &quicAcceptGate{}
+	gated := gate.listener(ln)
+
+	accepted := make(chan quic.EarlyConnection)
+	go func() {
+		for {
+			conn, err := gated.Accept(ctx)
+			if err != nil {
+				close(accepted)
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := quic.DialAddr(ctx, ln.Addr().String(), clientTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.CloseWithError(0, "")
+	served := <-accepted
+
+	// Once closed, new connections are turned away but those accepted
+	// before are left alone.
+	gate.close()
+	second, err := quic.DialAddr(ctx, ln.Addr().String(), clientTLS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-second.Context().Done()
+	// Closed before the handshake is confirmed, the error code is replaced
+	// by APPLICATION_ERROR (RFC 9000 10.2.3).
+	var transportErr *quic.TransportError
+	if err := context.Cause(second.Context()); !errors.As(err, &transportErr) || !transportErr.Remote || transportErr.ErrorCode != quic.ApplicationErrorErrorCode {
+		t.Errorf("connection accepted after closing the gate ended with %v, want it closed by the server", err)
+	}
+
+	if _, err := first.OpenUniStream(); err != nil {
+		t.Errorf("connection accepted before closing the gate: %v", err)
+	}
+	if err := served.Context().Err(); err != nil {
+		t.Errorf("connection accepted before closing the gate: %v", err)
+	}
+
+	cancel()
+	if conn, ok := <-accepted; ok {
+		t.Errorf("accepted %s after closing the gate", conn.RemoteAddr())
+	}
+}
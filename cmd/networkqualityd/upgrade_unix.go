@@ -0,0 +1,17 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyUpgrade relays the signal requesting a binary upgrade to c.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
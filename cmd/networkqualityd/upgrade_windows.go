@@ -0,0 +1,14 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// notifyUpgrade does nothing; upgrades rely on passing sockets to a child
+// process, which isn't supported on this platform.
+func notifyUpgrade(c chan<- os.Signal) {}
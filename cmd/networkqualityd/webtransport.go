@@ -0,0 +1,74 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/webtransport-go"
+)
+
+// An h3Server serves HTTP/3 on QUIC listeners.
+type h3Server interface {
+	ServeListener(ln http3.QUICEarlyListener) error
+	Close() error
+}
+
+// webTransportServer is an h3Server also serving WebTransport sessions,
+// which webtransport.Server can only do on connections handed to it. The
+// acceptors of a port share it, each serving their own listener, as the
+// webtransport.Server sets up its HTTP/3 server only once.
+type webTransportServer struct {
+	*webtransport.Server
+
+	mut    sync.Mutex
+	lns    map[http3.QUICEarlyListener]struct{}
+	closed bool
+}
+
+func (s *webTransportServer) ServeListener(ln http3.QUICEarlyListener) error {
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return http.ErrServerClosed
+	}
+	if s.lns == nil {
+		s.lns = make(map[http3.QUICEarlyListener]struct{})
+	}
+	s.lns[ln] = struct{}{}
+	s.mut.Unlock()
+
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			s.mut.Lock()
+			defer s.mut.Unlock()
+			delete(s.lns, ln)
+			if s.closed {
+				return http.ErrServerClosed
+			}
+			return err
+		}
+		go func() {
+			// Errors only tell how the connection ended.
+			_ = s.ServeQUICConn(conn)
+		}()
+	}
+}
+
+func (s *webTransportServer) Close() error {
+	s.mut.Lock()
+	if s.closed {
+		s.mut.Unlock()
+		return nil
+	}
+	s.closed = true
+	for ln := range s.lns {
+		ln.Close()
+	}
+	s.mut.Unlock()
+	return s.Server.Close()
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// withWebUIRedirect returns a handler sending browsers that open the
+// context path itself to the web UI, and everything else to h, which
+// serves the config there for older clients.
+func withWebUIRedirect(contextPath string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == contextPath+"/" && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			http.Redirect(w, r, contextPath+"/ui/", http.StatusFound)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
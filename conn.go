@@ -0,0 +1,81 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync/atomic"
+)
+
+type connContextKey struct{}
+
+// mptcpContextKey marks the connections of servers with EnableMPTCP set.
+type mptcpContextKey struct{}
+
+// ConnContext makes c available to the handlers serving requests on it. It
+// is suitable for use as http.Server.ConnContext.
+func ConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// TCPConnFromContext returns the TCP connection carrying the request with
+// context ctx, looking through TLS. It returns false for requests that did
+// not arrive over TCP (e.g. HTTP/3) or whose server did not use ConnContext.
+func TCPConnFromContext(ctx context.Context) (*net.TCPConn, bool) {
+	c, _ := ctx.Value(connContextKey{}).(net.Conn)
+	for c != nil {
+		switch conn := c.(type) {
+		case *net.TCPConn:
+			return conn, true
+		case interface{ NetConn() net.Conn }:
+			c = conn.NetConn()
+		default:
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// ConnContext counts the connections accepted for m and, when m.EnableMPTCP
+// is set, those that negotiated Multipath TCP. It is suitable for use as
+// http.Server.ConnContext.
+func (m *Server) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	ctx = ConnContext(ctx, c)
+	atomic.AddUint64(&m.Connections, 1)
+
+	if m.EnableMPTCP {
+		ctx = context.WithValue(ctx, mptcpContextKey{}, true)
+		if tcpConn, ok := TCPConnFromContext(ctx); ok {
+			isMPTCP, err := tcpConn.MultipathTCP()
+			switch {
+			case err != nil:
+				log.Printf("could not check MPTCP status of %s: %s", c.RemoteAddr(), err)
+			case isMPTCP:
+				atomic.AddUint64(&m.MPTCPConnections, 1)
+			}
+		}
+	}
+
+	return ctx
+}
+
+// isMPTCP reports whether the request with context ctx arrived on a Multipath
+// TCP connection. It returns nil if that is not known, or if its server
+// doesn't have EnableMPTCP set.
+func isMPTCP(ctx context.Context) *bool {
+	if enabled, _ := ctx.Value(mptcpContextKey{}).(bool); !enabled {
+		return nil
+	}
+	tcpConn, ok := TCPConnFromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	isMPTCP, err := tcpConn.MultipathTCP()
+	if err != nil {
+		return nil
+	}
+	return &isMPTCP
+}
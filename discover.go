@@ -0,0 +1,211 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/dnssd"
+)
+
+// A DiscoveredServer is a network quality server found through DNS-SD.
+type DiscoveredServer struct {
+	Instance  string            `json:"instance"`
+	Host      string            `json:"host"`
+	Port      int               `json:"port"`
+	IPs       []net.IP          `json:"ips"`
+	Interface string            `json:"interface"`
+	Text      map[string]string `json:"txt,omitempty"`
+
+	// ConfigURL is the config advertised in the TXT record; Address is the
+	// address it was fetched from, as the host name may not resolve outside
+	// of mDNS.
+	ConfigURL string            `json:"config_url"`
+	Address   string            `json:"address,omitempty"`
+	Config    *DiscoveredConfig `json:"config,omitempty"`
+	Error     string            `json:"error,omitempty"`
+}
+
+// DiscoveredConfig is the part of a server's config of interest to
+// discovery.
+type DiscoveredConfig struct {
+	Version      int               `json:"version"`
+	URLs         map[string]string `json:"urls"`
+	Capabilities []string          `json:"capabilities,omitempty"`
+}
+
+// Reachable reports whether the server's config could be fetched.
+func (s *DiscoveredServer) Reachable() bool {
+	return s.Config != nil
+}
+
+// Discover browses for network quality servers on the local network for
+// browseDuration, then fetches the config of each one found using client.
+// Servers that are found but can't be reached are returned with Error set.
+func Discover(ctx context.Context, browseDuration time.Duration, client *http.Client) ([]*DiscoveredServer, error) {
+	var mut sync.Mutex
+	found := make(map[string]*DiscoveredServer)
+
+	browseCtx, cancel := context.WithTimeout(ctx, browseDuration)
+	defer cancel()
+
+	add := func(e dnssd.BrowseEntry) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		// An instance is reported once per interface it is seen on.
+		if s, ok := found[e.ServiceInstanceName()]; ok {
+			s.IPs = appendNewIPs(s.IPs, e.IPs)
+			return
+		}
+		found[e.ServiceInstanceName()] = newDiscoveredServer(e)
+	}
+	err := dnssd.LookupType(browseCtx, fmt.Sprintf("%s.local.", ServiceType), add, func(dnssd.BrowseEntry) {})
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) && !errors.Is(err, context.Canceled) {
+		return nil, err
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	servers := make([]*DiscoveredServer, 0, len(found))
+	for _, s := range found {
+		servers = append(servers, s)
+	}
+	sort.Slice(servers, func(i, j int) bool { return servers[i].Instance < servers[j].Instance })
+
+	var wg sync.WaitGroup
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s *DiscoveredServer) {
+			defer wg.Done()
+			s.fetchConfig(ctx, client)
+		}(s)
+	}
+	wg.Wait()
+
+	return servers, nil
+}
+
+func newDiscoveredServer(e dnssd.BrowseEntry) *DiscoveredServer {
+	s := &DiscoveredServer{
+		Instance:  e.UnescapedName(),
+		Host:      strings.TrimSuffix(e.Host, "."),
+		Port:      e.Port,
+		IPs:       appendNewIPs(nil, e.IPs),
+		Interface: e.IfaceName,
+		Text:      e.Text,
+	}
+
+	// Servers that predate the TXT record only offered HTTPS.
+	scheme := e.Text["scheme"]
+	if len(scheme) == 0 {
+		scheme = "https"
+	}
+	path := e.Text["path"]
+	if len(path) == 0 {
+		path = "/.well-known/nq"
+	}
+	s.ConfigURL = fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), path)
+
+	return s
+}
+
+func appendNewIPs(ips []net.IP, more []net.IP) []net.IP {
+NextIP:
+	for _, ip := range more {
+		for _, known := range ips {
+			if known.Equal(ip) {
+				continue NextIP
+			}
+		}
+		ips = append(ips, ip)
+	}
+	return ips
+}
+
+// fetchConfig tries each of the server's addresses in turn. The requests
+// are made to ConfigURL, so that the Host header and TLS server name are the
+// announced host name, but connect to the discovered address.
+func (s *DiscoveredServer) fetchConfig(ctx context.Context, client *http.Client) {
+	var lastErr error
+	for _, ip := range s.IPs {
+		// IPv6 link-local addresses would need a zone.
+		if ip.To4() == nil && ip.IsLinkLocalUnicast() {
+			continue
+		}
+		address := net.JoinHostPort(ip.String(), strconv.Itoa(s.Port))
+
+		config, err := getConfig(ctx, dialingClient(client, address), s.ConfigURL)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		s.Address = address
+		s.Config = config
+		return
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no usable address")
+	}
+	s.Error = lastErr.Error()
+}
+
+// dialingClient returns a copy of client whose connections all go to
+// address.
+func dialingClient(client *http.Client, address string) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if client.Transport == nil {
+		transport, ok = http.DefaultTransport.(*http.Transport)
+	}
+	if !ok {
+		return client
+	}
+
+	transport = transport.Clone()
+	dialer := &net.Dialer{}
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return dialer.DialContext(ctx, network, address)
+	}
+	transport.Proxy = nil
+
+	c := *client
+	c.Transport = transport
+	return &c
+}
+
+func getConfig(ctx context.Context, client *http.Client, url string) (*DiscoveredConfig, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	defer client.CloseIdleConnections()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", url, resp.Status)
+	}
+
+	var config DiscoveredConfig
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&config); err != nil {
+		return nil, fmt.Errorf("%s: %w", url, err)
+	}
+	return &config, nil
+}
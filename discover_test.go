@@ -0,0 +1,205 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/brutella/dnssd"
+)
+
+func TestNewDiscoveredServer(t *testing.T) {
+	tests := []struct {
+		name string
+		text map[string]string
+		want string
+	}{
+		{"no TXT record", nil, "https://nq.local:4043/.well-known/nq"},
+		{"http", map[string]string{"scheme": "http"}, "http://nq.local:4043/.well-known/nq"},
+		{"path", map[string]string{"path": "/config"}, "https://nq.local:4043/config"},
+		{"both", map[string]string{"scheme": "http", "path": "/config"}, "http://nq.local:4043/config"},
+	}
+	for _, test := range tests {
+		s := newDiscoveredServer(dnssd.BrowseEntry{
+			Name:      `Office\ server`,
+			Host:      "nq.local.",
+			Port:      4043,
+			IPs:       []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.1"), net.ParseIP("fe80::1")},
+			IfaceName: "en0",
+			Text:      test.text,
+		})
+		if s.ConfigURL != test.want {
+			t.Errorf("%s: ConfigURL = %q, want %q", test.name, s.ConfigURL, test.want)
+		}
+		if s.Instance != "Office server" || s.Host != "nq.local" || s.Interface != "en0" || len(s.IPs) != 2 {
+			t.Errorf("%s: got %+v", test.name, s)
+		}
+	}
+}
+
+// discoveredServerFor returns a server announced as nq.local with the address
+// of the httptest server ts.
+func discoveredServerFor(t *testing.T, ts *httptest.Server, path string) *DiscoveredServer {
+	host, port, err := net.SplitHostPort(ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return newDiscoveredServer(dnssd.BrowseEntry{
+		Host: "nq.local.",
+		Port: p,
+		IPs:  []net.IP{net.ParseIP(host)},
+		Text: map[string]string{"scheme": "http", "path": path},
+	})
+}
+
+func TestFetchConfig(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		// Requests connect to the address but are made to the host name.
+		if r.Host != net.JoinHostPort("nq.local", strings.Split(r.Host, ":")[1]) {
+			http.Error(w, "wrong host "+r.Host, http.StatusMisdirectedRequest)
+			return
+		}
+		fmt.Fprint(w, `{"version": 1, "urls": {"small_https_download_url": "https://nq.local/small"}, "capabilities": ["l4s"]}`)
+	})
+	mux.HandleFunc("/bad", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": 1, "urls": [`)
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := &http.Client{Timeout: 200 * time.Millisecond}
+	tests := []struct {
+		path      string
+		wantError string
+	}{
+		{"/config", ""},
+		{"/missing", "404 Not Found"},
+		{"/bad", "unexpected EOF"},
+		{"/slow", "Client.Timeout exceeded"},
+	}
+	for _, test := range tests {
+		s := discoveredServerFor(t, ts, test.path)
+		s.fetchConfig(context.Background(), client)
+
+		if test.wantError != "" {
+			if s.Reachable() || !strings.Contains(s.Error, test.wantError) {
+				t.Errorf("%s: got config %+v, error %q, want an error containing %q", test.path, s.Config, s.Error, test.wantError)
+			}
+			continue
+		}
+		want := &DiscoveredConfig{
+			Version:      1,
+			URLs:         map[string]string{"small_https_download_url": "https://nq.local/small"},
+			Capabilities: []string{"l4s"},
+		}
+		if !reflect.DeepEqual(s.Config, want) || s.Error != "" {
+			t.Errorf("%s: got config %+v, error %q, want %+v", test.path, s.Config, s.Error, want)
+		}
+		if s.Address != ts.Listener.Addr().String() {
+			t.Errorf("%s: fetched from %q, want %q", test.path, s.Address, ts.Listener.Addr())
+		}
+	}
+}
+
+func TestFetchConfigAddresses(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": 1}`)
+	}))
+	defer ts.Close()
+
+	// Link-local IPv6 addresses are skipped, and those refusing connections
+	// tried past; ts only listens on 127.0.0.1.
+	s := discoveredServerFor(t, ts, "/")
+	s.IPs = append([]net.IP{net.ParseIP("fe80::1"), net.ParseIP("::1")}, s.IPs...)
+	s.fetchConfig(context.Background(), &http.Client{Timeout: time.Second})
+	if !s.Reachable() || s.Address != ts.Listener.Addr().String() {
+		t.Errorf("fetched from %q, error %q, want %q", s.Address, s.Error, ts.Listener.Addr())
+	}
+
+	s = discoveredServerFor(t, ts, "/")
+	s.IPs = []net.IP{net.ParseIP("fe80::1")}
+	s.fetchConfig(context.Background(), http.DefaultClient)
+	if s.Reachable() || s.Error != "no usable address" {
+		t.Errorf("got config %+v, error %q with only a link-local address, want no usable address", s.Config, s.Error)
+	}
+}
+
+func TestGetConfigContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if config, err := getConfig(ctx, ts.Client(), ts.URL); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("getConfig() = %+v, %v, want %v", config, err, context.DeadlineExceeded)
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"version": 1}`)
+	}))
+	defer ts.Close()
+	_, port, _ := net.SplitHostPort(ts.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	responder, err := dnssd.NewResponder()
+	if err != nil {
+		t.Skipf("no mDNS: %v", err)
+	}
+	service, err := dnssd.NewService(dnssd.Config{
+		Name: "Discover test",
+		Type: ServiceType,
+		Host: "nq-discover-test",
+		Text: map[string]string{"scheme": "http", "path": "/"},
+		IPs:  []net.IP{net.ParseIP("127.0.0.1")},
+		Port: p,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := responder.Add(service); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go responder.Respond(ctx)
+
+	// Browsing while the service is being probed finds it from the probes,
+	// which carry no TXT record, so browse until it has been announced.
+	var found *DiscoveredServer
+	for i := 0; i < 5 && (found == nil || !found.Reachable()); i++ {
+		servers, err := Discover(context.Background(), time.Second, &http.Client{Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range servers {
+			if s.Instance == "Discover test" {
+				found = s
+			}
+		}
+	}
+	if found == nil {
+		t.Skip("mDNS did not find the test server; multicast may be unavailable")
+	}
+	if !found.Reachable() || found.Address != ts.Listener.Addr().String() || found.ConfigURL != fmt.Sprintf("http://nq-discover-test:%d/", p) {
+		t.Errorf("found %+v, want it reachable at %s", found, ts.Listener.Addr())
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// maxLimitedClients is how many client addresses a clientLimiter
+	// tracks at once; others are refused until the limits of idle ones
+	// expire.
+	maxLimitedClients = 100000
+
+	// limiterSweepInterval is how often the limits of idle clients are
+	// forgotten.
+	limiterSweepInterval = time.Minute
+)
+
+// A clientLimiter limits what each client address may do with a token
+// bucket: rate tokens per second, in bursts of up to burst.
+type clientLimiter struct {
+	rate  float64
+	burst float64
+
+	mut       sync.Mutex
+	clients   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newClientLimiter(rate float64, burst int) *clientLimiter {
+	return &clientLimiter{
+		rate:      rate,
+		burst:     float64(max(burst, 1)),
+		clients:   make(map[netip.Addr]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow reports whether the client at ip may go ahead at now, taking a
+// token if so.
+func (l *clientLimiter) allow(ip netip.Addr, now time.Time) bool {
+	ip = ip.Unmap()
+
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if now.Sub(l.lastSweep) >= limiterSweepInterval {
+		l.sweep(now)
+	}
+
+	b, ok := l.clients[ip]
+	if !ok {
+		if len(l.clients) >= maxLimitedClients {
+			return false
+		}
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.clients[ip] = b
+	}
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets the clients whose buckets have filled up again, as new ones
+// start out full.
+func (l *clientLimiter) sweep(now time.Time) {
+	for ip, b := range l.clients {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.clients, ip)
+		}
+	}
+	l.lastSweep = now
+}
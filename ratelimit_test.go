@@ -0,0 +1,99 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientLimiter(t *testing.T) {
+	a := netip.MustParseAddr("192.0.2.1")
+	b := netip.MustParseAddr("2001:db8::1")
+	mappedA := netip.MustParseAddr("::ffff:192.0.2.1")
+
+	type attempt struct {
+		ip    netip.Addr
+		after time.Duration
+		want  bool
+	}
+	tests := []struct {
+		name     string
+		rate     float64
+		burst    int
+		attempts []attempt
+	}{
+		{
+			name: "burst", rate: 1, burst: 3,
+			attempts: []attempt{{a, 0, true}, {a, 0, true}, {a, 0, true}, {a, 0, false}},
+		},
+		{
+			name: "refill", rate: 2, burst: 1,
+			attempts: []attempt{{a, 0, true}, {a, 0, false}, {a, 250 * time.Millisecond, false}, {a, 250 * time.Millisecond, true}},
+		},
+		{
+			name: "refill up to the burst", rate: 10, burst: 2,
+			attempts: []attempt{{a, 0, true}, {a, 0, true}, {a, time.Hour, true}, {a, 0, true}, {a, 0, false}},
+		},
+		{
+			name: "clients apart", rate: 1, burst: 1,
+			attempts: []attempt{{a, 0, true}, {a, 0, false}, {b, 0, true}, {b, 0, false}},
+		},
+		{
+			name: "IPv4-mapped addresses", rate: 1, burst: 1,
+			attempts: []attempt{{a, 0, true}, {mappedA, 0, false}},
+		},
+		{
+			name: "no burst", rate: 1, burst: 0,
+			attempts: []attempt{{a, 0, true}, {a, 0, false}},
+		},
+	}
+	for _, test := range tests {
+		l := newClientLimiter(test.rate, test.burst)
+		now := time.Now()
+		for i, attempt := range test.attempts {
+			now = now.Add(attempt.after)
+			if got := l.allow(attempt.ip, now); got != attempt.want {
+				t.Errorf("%s: attempt %d from %s = %t, want %t", test.name, i, attempt.ip, got, attempt.want)
+			}
+		}
+	}
+}
+
+func TestClientLimiterSweep(t *testing.T) {
+	l := newClientLimiter(1, 2)
+	now := time.Now()
+	busy, idle := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	l.allow(busy, now)
+	l.allow(busy, now)
+	l.allow(idle, now)
+
+	// After a second, the idle client's bucket is full again but the busy
+	// one's isn't.
+	l.sweep(now.Add(time.Second))
+	if _, ok := l.clients[idle]; ok {
+		t.Error("idle client not forgotten")
+	}
+	if _, ok := l.clients[busy]; !ok {
+		t.Error("busy client forgotten")
+	}
+}
+
+func TestClientLimiterFull(t *testing.T) {
+	l := newClientLimiter(1, 1)
+	now := time.Now()
+	for i := 0; i < maxLimitedClients; i++ {
+		ip := netip.AddrFrom4([4]byte{10, byte(i >> 16), byte(i >> 8), byte(i)})
+		if !l.allow(ip, now) {
+			t.Fatalf("client %d refused", i)
+		}
+	}
+	if l.allow(netip.MustParseAddr("192.0.2.1"), now) {
+		t.Error("new client allowed beyond maxLimitedClients")
+	}
+	// Once their buckets refill, the clients are forgotten to make room.
+	if !l.allow(netip.MustParseAddr("192.0.2.1"), now.Add(limiterSweepInterval)) {
+		t.Error("new client refused after the sweep")
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// NextProtoRawQUIC is the ALPN identifier of raw QUIC measurement
+// connections, which are served next to HTTP/3 on its UDP port.
+const NextProtoRawQUIC = "nq-quic"
+
+// The first byte a client sends on a bidirectional stream of a raw QUIC
+// connection picks what the stream measures.
+const (
+	// RawQUICStreamDownload streams are flooded by the server until the
+	// client stops reading them.
+	RawQUICStreamDownload = 'd'
+
+	// RawQUICStreamUpload streams are discarded by the server until the
+	// client closes them, after which the server replies with the number
+	// of bytes it received (8 bytes, big endian).
+	RawQUICStreamUpload = 'u'
+
+	// RawQUICStreamEcho streams are echoed back as they arrive, for
+	// latency probes within a stream.
+	RawQUICStreamEcho = 'e'
+)
+
+// rawQUICUnknownStream is the error code of streams of unknown types.
+const rawQUICUnknownStream quic.StreamErrorCode = 1
+
+// RawQUICServer serves raw QUIC measurement connections, which measure the
+// transport without any HTTP framing:
+//
+//   - bidirectional streams, opened by the client, transfer bulk data or
+//     echo probes, depending on their first byte; see RawQUICStreamDownload.
+//   - every QUIC datagram the client sends is echoed, with the time the
+//     server received it appended as nanoseconds since the Unix epoch (8
+//     bytes, big endian).
+//
+// The QUIC listener must enable datagrams.
+type RawQUICServer struct {
+	BytesServed   *uint64
+	BytesReceived *uint64
+}
+
+// RawQUICTLSConfig returns a config for a QUIC listener serving HTTP/3 and,
+// with NextProtoRawQUIC, raw QUIC measurement connections.
+func RawQUICTLSConfig(tlsConf *tls.Config) *tls.Config {
+	h3Conf := http3.ConfigureTLSConfig(tlsConf)
+	return &tls.Config{
+		GetConfigForClient: func(ch *tls.ClientHelloInfo) (*tls.Config, error) {
+			config, err := h3Conf.GetConfigForClient(ch)
+			if config == nil || err != nil {
+				return config, err
+			}
+			config.NextProtos = append(config.NextProtos, NextProtoRawQUIC)
+			return config, nil
+		},
+	}
+}
+
+// Listener returns a listener passing on the HTTP/3 connections accepted
+// from ln, and serving the raw QUIC ones itself.
+func (s *RawQUICServer) Listener(ln http3.QUICEarlyListener) http3.QUICEarlyListener {
+	return &rawQUICListener{QUICEarlyListener: ln, s: s}
+}
+
+type rawQUICListener struct {
+	http3.QUICEarlyListener
+	s *RawQUICServer
+}
+
+func (l *rawQUICListener) Accept(ctx context.Context) (quic.EarlyConnection, error) {
+	for {
+		conn, err := l.QUICEarlyListener.Accept(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if conn.ConnectionState().TLS.NegotiatedProtocol != NextProtoRawQUIC {
+			return conn, nil
+		}
+		go l.s.ServeConn(conn)
+	}
+}
+
+// ServeConn serves a raw QUIC connection until it is closed.
+func (s *RawQUICServer) ServeConn(conn quic.EarlyConnection) {
+	// Streams and datagrams may only be trusted once the client proved
+	// its address.
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		return
+	}
+
+	go s.echoDatagrams(conn)
+
+	ctx := conn.Context()
+	for {
+		str, err := conn.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go s.serveStream(str)
+	}
+}
+
+func (s *RawQUICServer) serveStream(str quic.Stream) {
+	var kind [1]byte
+	if _, err := io.ReadFull(str, kind[:]); err != nil {
+		str.CancelWrite(rawQUICUnknownStream)
+		return
+	}
+	atomic.AddUint64(s.BytesReceived, 1)
+
+	switch kind[0] {
+	case RawQUICStreamDownload:
+		str.CancelRead(0)
+		for {
+			n, err := str.Write(buffed)
+			atomic.AddUint64(s.BytesServed, uint64(n))
+			if err != nil {
+				return
+			}
+		}
+
+	case RawQUICStreamUpload:
+		n, err := io.Copy(countingDiscard{byteCounter: s.BytesReceived}, str)
+		if err != nil {
+			str.CancelWrite(0)
+			return
+		}
+		if _, err := str.Write(binary.BigEndian.AppendUint64(nil, uint64(n))); err == nil {
+			atomic.AddUint64(s.BytesServed, 8)
+		}
+		str.Close()
+
+	case RawQUICStreamEcho:
+		buf := make([]byte, chunkSize)
+		for {
+			n, err := str.Read(buf)
+			atomic.AddUint64(s.BytesReceived, uint64(n))
+			if n > 0 {
+				written, werr := str.Write(buf[:n])
+				atomic.AddUint64(s.BytesServed, uint64(written))
+				if werr != nil {
+					return
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				str.Close()
+				return
+			}
+			if err != nil {
+				str.CancelWrite(0)
+				return
+			}
+		}
+
+	default:
+		str.CancelRead(rawQUICUnknownStream)
+		str.CancelWrite(rawQUICUnknownStream)
+	}
+}
+
+// echoDatagrams echoes the datagrams of conn until it is closed.
+func (s *RawQUICServer) echoDatagrams(conn quic.Connection) {
+	for {
+		datagram, err := conn.ReceiveMessage(conn.Context())
+		if err != nil {
+			return
+		}
+		received := time.Now()
+
+		atomic.AddUint64(s.BytesReceived, uint64(len(datagram)))
+		reply := appendTimestamp(datagram, received)
+		if err := conn.SendMessage(reply); err == nil {
+			atomic.AddUint64(s.BytesServed, uint64(len(reply)))
+		}
+	}
+}
+
+// appendTimestamp appends t to b as nanoseconds since the Unix epoch (8
+// bytes, big endian), as echoed datagrams carry it.
+func appendTimestamp(b []byte, t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(b, uint64(t.UnixNano()))
+}
@@ -0,0 +1,200 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// rawQUICTest is a raw QUIC server sharing its listener with HTTP/3, as
+// networkqualityd runs it.
+type rawQUICTest struct {
+	server                     *RawQUICServer
+	addr                       string
+	roots                      *x509.CertPool
+	bytesServed, bytesReceived uint64
+}
+
+func newRawQUICTest(t *testing.T) *rawQUICTest {
+	// Borrow the certificate of httptest, which is valid for 127.0.0.1.
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	test := &rawQUICTest{roots: x509.NewCertPool()}
+	test.roots.AddCert(certServer.Certificate())
+	test.server = &RawQUICServer{BytesServed: &test.bytesServed, BytesReceived: &test.bytesReceived}
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	test.addr = pc.LocalAddr().String()
+	tlsConf := RawQUICTLSConfig(&tls.Config{Certificates: certServer.TLS.Certificates})
+	ln, err := quic.ListenEarly(pc, tlsConf, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	h3 := &http3.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.Proto)
+	})}
+	go h3.ServeListener(test.server.Listener(ln))
+	t.Cleanup(func() { h3.Close() })
+	return test
+}
+
+// dial returns a raw QUIC connection to the server.
+func (test *rawQUICTest) dial(t *testing.T) quic.Connection {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	tlsConf := &tls.Config{RootCAs: test.roots, NextProtos: []string{NextProtoRawQUIC}}
+	conn, err := quic.DialAddr(ctx, test.addr, tlsConf, &quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.CloseWithError(0, "") })
+	return conn
+}
+
+// openStream opens a stream of the given kind.
+func openStream(t *testing.T, conn quic.Connection, kind byte) quic.Stream {
+	str, err := conn.OpenStreamSync(conn.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := str.Write([]byte{kind}); err != nil {
+		t.Fatal(err)
+	}
+	str.SetDeadline(time.Now().Add(5 * time.Second))
+	return str
+}
+
+func TestRawQUICListener(t *testing.T) {
+	test := newRawQUICTest(t)
+
+	// HTTP/3 connections are passed on to the HTTP/3 server...
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{RootCAs: test.roots}}
+	defer rt.Close()
+	client := &http.Client{Transport: rt, Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("https://%s/", test.addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "HTTP/3.0" {
+		t.Errorf("got %q, %v over HTTP/3, want HTTP/3.0", body, err)
+	}
+
+	// ...and raw QUIC ones served alongside.
+	conn := test.dial(t)
+	if got := conn.ConnectionState().TLS.NegotiatedProtocol; got != NextProtoRawQUIC {
+		t.Fatalf("negotiated %q, want %q", got, NextProtoRawQUIC)
+	}
+	str := openStream(t, conn, RawQUICStreamEcho)
+	str.Write([]byte("ping"))
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(str, reply); err != nil || string(reply) != "ping" {
+		t.Errorf("got echo %q, %v, want ping", reply, err)
+	}
+}
+
+func TestRawQUICStreams(t *testing.T) {
+	test := newRawQUICTest(t)
+	conn := test.dial(t)
+
+	t.Run("download", func(t *testing.T) {
+		str := openStream(t, conn, RawQUICStreamDownload)
+		if n, err := io.CopyN(io.Discard, str, 1<<20); err != nil {
+			t.Fatalf("got %d bytes, %v", n, err)
+		}
+		str.CancelRead(0)
+		str.Close()
+		if served := atomic.LoadUint64(&test.bytesServed); served < 1<<20 {
+			t.Errorf("counted %d bytes served, want at least %d", served, 1<<20)
+		}
+	})
+
+	t.Run("upload", func(t *testing.T) {
+		const size = 100000
+		str := openStream(t, conn, RawQUICStreamUpload)
+		if _, err := io.Copy(str, strings.NewReader(strings.Repeat("x", size))); err != nil {
+			t.Fatal(err)
+		}
+		str.Close()
+
+		reply, err := io.ReadAll(str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply) != 8 || binary.BigEndian.Uint64(reply) != size {
+			t.Errorf("got reply %x, want %d as 8 bytes", reply, size)
+		}
+	})
+
+	t.Run("echo", func(t *testing.T) {
+		str := openStream(t, conn, RawQUICStreamEcho)
+		for _, probe := range []string{"first", "second"} {
+			str.Write([]byte(probe))
+			reply := make([]byte, len(probe))
+			if _, err := io.ReadFull(str, reply); err != nil || string(reply) != probe {
+				t.Errorf("got echo %q, %v, want %q", reply, err, probe)
+			}
+		}
+		str.Close()
+		if rest, err := io.ReadAll(str); err != nil || len(rest) > 0 {
+			t.Errorf("got %q, %v after closing the stream, want EOF", rest, err)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		str := openStream(t, conn, 'x')
+		_, err := str.Read(make([]byte, 1))
+		var streamErr *quic.StreamError
+		if !errors.As(err, &streamErr) || streamErr.ErrorCode != rawQUICUnknownStream {
+			t.Errorf("got %v, want stream error %d", err, rawQUICUnknownStream)
+		}
+	})
+}
+
+func TestRawQUICDatagrams(t *testing.T) {
+	test := newRawQUICTest(t)
+	conn := test.dial(t)
+
+	probe := []byte("probe")
+	before := time.Now()
+	if err := conn.SendMessage(probe); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(conn.Context(), 5*time.Second)
+	defer cancel()
+	reply, err := conn.ReceiveMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != len(probe)+8 || !bytes.Equal(reply[:len(probe)], probe) {
+		t.Fatalf("got reply %x to %x, want it with a timestamp appended", reply, probe)
+	}
+	received := time.Unix(0, int64(binary.BigEndian.Uint64(reply[len(probe):])))
+	if received.Before(before) || received.After(time.Now()) {
+		t.Errorf("got receive time %v, want between %v and now", received, before)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"net/http"
+	"sync/atomic"
+)
+
+// A CountingResponseWriter records the status, the bytes written and the
+// first write error of a response, for handlers reporting on the requests
+// of those they wrap.
+type CountingResponseWriter struct {
+	http.ResponseWriter
+	Status  int
+	Written int64
+	Err     error
+
+	// Served, if set, is added the bytes written as they are, so that
+	// others can follow the response while it is being written.
+	Served *atomic.Uint64
+}
+
+// NewCountingResponseWriter returns a CountingResponseWriter for w.
+func NewCountingResponseWriter(w http.ResponseWriter) *CountingResponseWriter {
+	return &CountingResponseWriter{ResponseWriter: w, Status: http.StatusOK}
+}
+
+func (w *CountingResponseWriter) WriteHeader(status int) {
+	w.Status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *CountingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.Written += int64(n)
+	if w.Served != nil {
+		w.Served.Add(uint64(n))
+	}
+	if err != nil && w.Err == nil {
+		w.Err = err
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (w *CountingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush flushes the underlying writer, looking through other wrappers.
+func (w *CountingResponseWriter) Flush() {
+	_ = http.NewResponseController(w.ResponseWriter).Flush()
+}
@@ -0,0 +1,60 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// failingWriter fails writes after its first n bytes.
+type failingWriter struct {
+	http.ResponseWriter
+	n int
+}
+
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		n, _ := w.ResponseWriter.Write(b[:w.n])
+		w.n = 0
+		return n, errors.New("broken pipe")
+	}
+	w.n -= len(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *failingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func TestCountingResponseWriter(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	var served atomic.Uint64
+	served.Add(100)
+	w := NewCountingResponseWriter(&failingWriter{ResponseWriter: recorder, n: 5})
+	w.Served = &served
+
+	if w.Status != http.StatusOK {
+		t.Errorf("status before writing = %d, want 200", w.Status)
+	}
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write([]byte("abc"))
+	w.Write([]byte("defg"))
+	w.Write([]byte("h"))
+
+	if w.Status != http.StatusPartialContent || recorder.Code != http.StatusPartialContent {
+		t.Errorf("status = %d, recorded %d, want 206", w.Status, recorder.Code)
+	}
+	if w.Written != 5 || served.Load() != 105 {
+		t.Errorf("counted %d bytes written, %d served, want 5 and 105", w.Written, served.Load())
+	}
+	if w.Err == nil || w.Err.Error() != "broken pipe" {
+		t.Errorf("error = %v, want the first one", w.Err)
+	}
+	if err := http.NewResponseController(w).Flush(); err != nil || !recorder.Flushed {
+		t.Errorf("Flush() = %v, flushed %t", err, recorder.Flushed)
+	}
+}
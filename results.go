@@ -0,0 +1,382 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// maxResultSize is the largest result body accepted.
+	maxResultSize = 64 * 1024
+
+	// maxResultString is the longest client metadata string accepted.
+	maxResultString = 256
+
+	// defaultResultLimit and maxResultLimit bound the results returned by
+	// a query.
+	defaultResultLimit = 1000
+	maxResultLimit     = 100000
+)
+
+// A Result is what a client measured in a test, as submitted to the results
+// URL. ID, Time, ClientAddr and Session are filled in by the server.
+type Result struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	ClientAddr string    `json:"client_addr"`
+
+	// Session is the session the result was submitted for, if the results
+	// URL named one.
+	Session string `json:"session,omitempty"`
+
+	// RPM is the responsiveness in round-trips per minute. Capacities are
+	// in bits per second and the idle latency in milliseconds.
+	RPM              float64 `json:"rpm"`
+	DownloadCapacity float64 `json:"download_capacity_bps"`
+	UploadCapacity   float64 `json:"upload_capacity_bps"`
+	IdleLatency      float64 `json:"idle_latency_ms"`
+
+	Client ResultClient `json:"client"`
+}
+
+// ResultClient describes the client that submitted a Result. All of it is
+// optional.
+type ResultClient struct {
+	Name      string `json:"name,omitempty"`
+	Version   string `json:"version,omitempty"`
+	Platform  string `json:"platform,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+// validate returns why r can't be stored, if it can't.
+func (r *Result) validate() error {
+	if !(r.RPM > 0) {
+		return errors.New("rpm must be positive")
+	}
+	numbers := []struct {
+		name  string
+		value float64
+	}{
+		{"rpm", r.RPM},
+		{"download_capacity_bps", r.DownloadCapacity},
+		{"upload_capacity_bps", r.UploadCapacity},
+		{"idle_latency_ms", r.IdleLatency},
+	}
+	for _, n := range numbers {
+		if n.value < 0 || math.IsInf(n.value, 0) || math.IsNaN(n.value) {
+			return fmt.Errorf("%s must be a non-negative number", n.name)
+		}
+	}
+	for _, s := range []string{r.Session, r.Client.Name, r.Client.Version, r.Client.Platform, r.Client.Interface} {
+		if len(s) > maxResultString {
+			return fmt.Errorf("session and client metadata are limited to %d bytes per field", maxResultString)
+		}
+	}
+	return nil
+}
+
+// A ResultQuery selects stored results. Zero fields match everything.
+type ResultQuery struct {
+	Since, Until time.Time
+
+	// Client matches the client name and ClientNet the client address.
+	Client    string
+	ClientNet *net.IPNet
+
+	// Session matches the session the result was submitted for.
+	Session string
+
+	// Limit is the number of most recent matches returned.
+	Limit int
+}
+
+func (q *ResultQuery) match(r *Result) bool {
+	switch {
+	case !q.Since.IsZero() && r.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !r.Time.Before(q.Until):
+		return false
+	case len(q.Client) > 0 && r.Client.Name != q.Client:
+		return false
+	case len(q.Session) > 0 && r.Session != q.Session:
+		return false
+	case q.ClientNet != nil && !q.ClientNet.Contains(net.ParseIP(r.ClientAddr)):
+		return false
+	}
+	return true
+}
+
+// ErrResultStoreFull is returned for results that would grow a ResultStore
+// beyond its maximum size.
+var ErrResultStoreFull = errors.New("result store is full")
+
+// ResultLimits bound what clients may submit to a ResultStore. Zero fields
+// mean no limit.
+type ResultLimits struct {
+	// MaxSize is the size, in bytes, the file may grow to.
+	MaxSize int64
+
+	// PerClientPerHour is how many results each client address may submit
+	// in an hour, in bursts of up to as many.
+	PerClientPerHour int
+}
+
+// A ResultStore keeps submitted results in a file, one JSON line each.
+// Queries read the whole file, so it may grow without the server growing,
+// but every query costs a pass over the file; its maximum size bounds that.
+type ResultStore struct {
+	limits  ResultLimits
+	limiter *clientLimiter
+
+	mut  sync.Mutex
+	path string
+	f    *os.File
+	size int64
+}
+
+// OpenResultStore opens the store in the file at path, which is created if
+// needed, accepting results within limits.
+func OpenResultStore(path string, limits ResultLimits) (*ResultStore, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	s := &ResultStore{limits: limits, path: path, f: f, size: info.Size()}
+	if limits.PerClientPerHour > 0 {
+		s.limiter = newClientLimiter(float64(limits.PerClientPerHour)/3600, limits.PerClientPerHour)
+	}
+	return s, nil
+}
+
+// Add validates r and stores it, filling in its ID and Time. It returns
+// ErrResultStoreFull once the store reached its maximum size.
+func (s *ResultStore) Add(r *Result) error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	r.ID = hex.EncodeToString(id)
+	r.Time = time.Now().UTC()
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	b = append(b, '\n')
+
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if s.limits.MaxSize > 0 && s.size+int64(len(b)) > s.limits.MaxSize {
+		return ErrResultStoreFull
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// Query returns the stored results matching q, oldest first.
+func (s *ResultStore) Query(q ResultQuery) ([]Result, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultResultLimit
+	}
+
+	// Only the last limit matches are kept, in a ring starting at next
+	// once it is full.
+	results := []Result{}
+	next := 0
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 4096), maxResultSize*2)
+	for scanner.Scan() {
+		var r Result
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			// A line cut short by a crash is no reason to give up on the rest.
+			continue
+		}
+		if !q.match(&r) {
+			continue
+		}
+		if len(results) < limit {
+			results = append(results, r)
+			continue
+		}
+		results[next] = r
+		next = (next + 1) % limit
+	}
+	return append(results[next:], results[:next]...), scanner.Err()
+}
+
+// Close closes the store's file.
+func (s *ResultStore) Close() error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	return s.f.Close()
+}
+
+// SubmitHandler accepts a Result POSTed as JSON and replies with it as
+// stored. Clients beyond their limit get a 429, and all of them a 507 once
+// the store is full.
+func (s *ResultStore) SubmitHandler(enableCORS bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if enableCORS {
+			setCors(w.Header())
+		}
+		if r.Method == http.MethodOptions && enableCORS {
+			w.Header().Set("Access-Control-Allow-Methods", "POST")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !s.allow(r.RemoteAddr) {
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(time.Hour.Seconds())/s.limits.PerClientPerHour)))
+			http.Error(w, "too many results", http.StatusTooManyRequests)
+			return
+		}
+
+		var result Result
+		decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxResultSize))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&result); err != nil {
+			http.Error(w, "invalid result: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		result.ClientAddr = remoteIP(r.RemoteAddr)
+		result.Session = r.URL.Query().Get(SessionParameter)
+		if err := result.validate(); err != nil {
+			http.Error(w, "invalid result: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := s.Add(&result); errors.Is(err, ErrResultStoreFull) {
+			http.Error(w, "could not store result: "+err.Error(), http.StatusInsufficientStorage)
+			return
+		} else if err != nil {
+			log.Printf("could not store result: %v", err)
+			http.Error(w, "could not store result", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		if err := json.NewEncoder(w).Encode(result); !ignorableError(err) {
+			log.Printf("could not write result: %s", err)
+		}
+	}
+}
+
+// QueryHandler replies to GET requests with the stored results as a JSON
+// array, reading the whole store. The since and until parameters (RFC 3339) select a time range,
+// client a client name, client_addr a client address or network (CIDR),
+// session a session, and limit how many of the most recent matches are returned.
+func (s *ResultStore) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	q, err := parseResultQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results, err := s.Query(q)
+	if err != nil {
+		log.Printf("could not query results: %v", err)
+		http.Error(w, "could not query results", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(results); !ignorableError(err) {
+		log.Printf("could not write results: %s", err)
+	}
+}
+
+func parseResultQuery(r *http.Request) (ResultQuery, error) {
+	params := r.URL.Query()
+	q := ResultQuery{Client: params.Get("client"), Session: params.Get(SessionParameter)}
+
+	var err error
+	if v := params.Get("since"); len(v) > 0 {
+		if q.Since, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("since: %v", err)
+		}
+	}
+	if v := params.Get("until"); len(v) > 0 {
+		if q.Until, err = time.Parse(time.RFC3339, v); err != nil {
+			return q, fmt.Errorf("until: %v", err)
+		}
+	}
+	if v := params.Get("client_addr"); len(v) > 0 {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return q, fmt.Errorf("client_addr: invalid address %q", v)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			q.ClientNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		} else if _, q.ClientNet, err = net.ParseCIDR(v); err != nil {
+			return q, fmt.Errorf("client_addr: %v", err)
+		}
+	}
+	if v := params.Get("limit"); len(v) > 0 {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 1 || q.Limit > maxResultLimit {
+			return q, fmt.Errorf("limit must be from 1 to %d", maxResultLimit)
+		}
+	}
+	return q, nil
+}
+
+// allow reports whether the client at remoteAddr is within its limit.
+func (s *ResultStore) allow(remoteAddr string) bool {
+	if s.limiter == nil {
+		return true
+	}
+	addrPort, err := netip.ParseAddrPort(remoteAddr)
+	return err == nil && s.limiter.allow(addrPort.Addr(), time.Now())
+}
+
+// remoteIP returns the IP address of a request's RemoteAddr.
+func remoteIP(address string) string {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestResultStoreQuery(t *testing.T) {
+	start := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	stored := []Result{
+		{ID: "a", Time: start, ClientAddr: "192.0.2.1", Session: "s1", RPM: 100, Client: ResultClient{Name: "web"}},
+		{ID: "b", Time: start.Add(time.Minute), ClientAddr: "192.0.2.2", Session: "s1", RPM: 200, Client: ResultClient{Name: "cli"}},
+		{ID: "c", Time: start.Add(2 * time.Minute), ClientAddr: "198.51.100.1", RPM: 300, Client: ResultClient{Name: "web"}},
+		{ID: "d", Time: start.Add(3 * time.Minute), ClientAddr: "2001:db8::1", Session: "s2", RPM: 400, Client: ResultClient{Name: "web"}},
+	}
+
+	path := filepath.Join(t.TempDir(), "results.jsonl")
+	var b []byte
+	for i, r := range stored {
+		line, err := json.Marshal(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = append(append(b, line...), '\n')
+		if i == 1 {
+			// Lines cut short by a crash are skipped.
+			b = append(b, `{"id":"x","time":`+"\n"...)
+		}
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := OpenResultStore(path, ResultLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_, documentation, _ := net.ParseCIDR("192.0.2.0/24")
+	tests := []struct {
+		name  string
+		query ResultQuery
+		want  []string
+	}{
+		{"everything", ResultQuery{}, []string{"a", "b", "c", "d"}},
+		{"since", ResultQuery{Since: start.Add(time.Minute)}, []string{"b", "c", "d"}},
+		{"until", ResultQuery{Until: start.Add(2 * time.Minute)}, []string{"a", "b"}},
+		{"between", ResultQuery{Since: start.Add(time.Minute), Until: start.Add(3 * time.Minute)}, []string{"b", "c"}},
+		{"client", ResultQuery{Client: "web"}, []string{"a", "c", "d"}},
+		{"client network", ResultQuery{ClientNet: documentation}, []string{"a", "b"}},
+		{"session", ResultQuery{Session: "s1"}, []string{"a", "b"}},
+		{"client and session", ResultQuery{Client: "web", Session: "s1"}, []string{"a"}},
+		{"limit", ResultQuery{Limit: 2}, []string{"c", "d"}},
+		{"limit of matches", ResultQuery{Client: "web", Limit: 2}, []string{"c", "d"}},
+		{"limit above matches", ResultQuery{Session: "s1", Limit: 5}, []string{"a", "b"}},
+		{"no match", ResultQuery{Client: "other"}, []string{}},
+	}
+	for _, test := range tests {
+		results, err := s.Query(test.query)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		got := []string{}
+		for _, r := range results {
+			got = append(got, r.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Query() = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestResultStoreFull(t *testing.T) {
+	s, err := OpenResultStore(filepath.Join(t.TempDir(), "results.jsonl"), ResultLimits{MaxSize: 500})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	for i := 0; ; i++ {
+		err := s.Add(&Result{RPM: 100})
+		if errors.Is(err, ErrResultStoreFull) {
+			if i == 0 {
+				t.Fatal("first result refused")
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.size > 500 {
+			t.Fatalf("store grew to %d bytes", s.size)
+		}
+	}
+}
+
+func TestResultValidate(t *testing.T) {
+	long := string(make([]byte, maxResultString+1))
+	tests := []struct {
+		name    string
+		result  Result
+		wantErr bool
+	}{
+		{"valid", Result{RPM: 1000, DownloadCapacity: 1e9, UploadCapacity: 1e8, IdleLatency: 12.5}, false},
+		{"no rpm", Result{}, true},
+		{"negative rpm", Result{RPM: -1}, true},
+		{"negative capacity", Result{RPM: 1000, DownloadCapacity: -1}, true},
+		{"infinite latency", Result{RPM: 1000, IdleLatency: math.Inf(1)}, true},
+		{"NaN capacity", Result{RPM: 1000, UploadCapacity: math.NaN()}, true},
+		{"long session", Result{RPM: 1000, Session: long}, true},
+		{"long client name", Result{RPM: 1000, Client: ResultClient{Name: long}}, true},
+	}
+	for _, test := range tests {
+		if err := test.result.validate(); (err != nil) != test.wantErr {
+			t.Errorf("%s: validate() = %v, want error %t", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -3,18 +3,22 @@
 package goserver
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
 
 	"strconv"
+	"strings"
 )
 
 const (
@@ -22,6 +26,9 @@ const (
 	largeContentLength int64 = 8 * 1024 * 1024 * 1024
 	chunkSize          int64 = 64 * 1024
 
+	// configVersion is the version of the generated config format.
+	configVersion = 1
+
 	// ServiceType is the dns-sd service type for this service
 	ServiceType = "_nq._tcp"
 )
@@ -69,6 +76,31 @@ func CountingBulkHandlers(prefix string, EnableCORS bool, bytesServed, bytesRece
 	}
 }
 
+// A CongestionControlEndpoint is a listener serving the measurement URLs
+// with a particular TCP congestion control algorithm.
+type CongestionControlEndpoint struct {
+	Algorithm      string
+	Scheme         string
+	PublicHostPort string
+}
+
+// An HTTP1Endpoint is a listener serving the measurement URLs over
+// HTTP/1.1 only, so that the socket options requests choose for their
+// connection, such as DSCPParameter, apply to them alone.
+type HTTP1Endpoint struct {
+	Scheme         string
+	PublicHostPort string
+}
+
+// DSCPParameter is the request parameter selecting the DSCP marking of the
+// connection serving a measurement, e.g. /large?dscp=ef.
+const DSCPParameter = "dscp"
+
+// PacingRateParameter is the request parameter capping, in bits per second,
+// the rate at which the connection serving a measurement sends, e.g.
+// /large?max_pacing_rate=50M.
+const PacingRateParameter = "max_pacing_rate"
+
 // A Server defines parameters for running a network quality server.
 type Server struct {
 	PublicPort     int
@@ -77,51 +109,94 @@ type Server struct {
 	Scheme         string
 	EnableCORS     bool
 	EnableH3AltSvc bool
+	EnableMPTCP    bool
 	BytesServed    uint64
 	BytesReceived  uint64
 
+	// Protocols lists the HTTP versions offered, by ALPN identifier (e.g.
+	// "h2", "h3"), for DNS-SD clients; see TXTRecord.
+	Protocols []string
+
+	// Capabilities lists optional features of this server, such as "l4s",
+	// for clients to find in the generated config.
+	Capabilities []string
+
+	// CongestionControlEndpoints are listed in the generated config so that
+	// clients can compare algorithms against the same host.
+	CongestionControlEndpoints []CongestionControlEndpoint
+
+	// HTTP1Endpoint, if set, is listed in the generated config, as are
+	// DSCPMarkings on it.
+	HTTP1Endpoint *HTTP1Endpoint
+
+	// DSCPMarkings are the DSCP names or values (see DSCPParameter) for which
+	// the generated config lists measurement URLs of the HTTP1Endpoint.
+	DSCPMarkings []string
+
+	// EnableResults lists the URL clients submit their results to, which
+	// is served by a ResultStore's SubmitHandler, in the generated config.
+	EnableResults bool
+
+	// EnableWebSocket lists the URLs of CountingWebSocketHandlers in the
+	// generated config.
+	EnableWebSocket bool
+
+	// EnableWebTransport lists the URL of CountingWebTransportHandlers in
+	// the generated config.
+	EnableWebTransport bool
+
+	// EnableRawQUIC lists the address of the RawQUICServer serving next to
+	// HTTP/3 in the generated config, as a quic:// URL.
+	EnableRawQUIC bool
+
+	// UDPEchoHostPort, if set, is where clients reach a UDPEchoServer,
+	// listed in the generated config as a udp:// URL.
+	UDPEchoHostPort string
+
+	// Sessions, if set, mints a session for each config served, whose
+	// URLs carry it in SessionParameter.
+	Sessions *SessionTracker
+
+	// Connections and MPTCPConnections count the connections accepted, and
+	// how many of those negotiated Multipath TCP; see ConnContext.
+	Connections      uint64
+	MPTCPConnections uint64
+
+	// ECNConnections counts the connections that negotiated ECN and CEMarks
+	// the CE marked packets their peers reported. They are maintained by
+	// whoever accepts the connections, as only they can inspect the socket.
+	ECNConnections uint64
+	CEMarks        uint64
+
 	generatedConfig []byte
 	once            sync.Once
 }
 
+// PrintStats logs the throughput of the server every second, forever.
+//
+// Deprecated: Use a StatsReporter, which can be stopped.
 func (m *Server) PrintStats() {
-	var lastBytesServed uint64
-	var lastBytesReceived uint64
-	for {
-		var msg string
-		x := atomic.LoadUint64(&m.BytesServed)
-		y := atomic.LoadUint64(&m.BytesReceived)
-
-		if x > lastBytesServed {
-			dur := time.Second
-			delta := x - lastBytesServed
-			bps := float64(delta) / dur.Seconds()
-			throughput := (bps / float64(1024*1024) * 8)
-
-			msg += fmt.Sprintf("Sent: %0.2fMbps", throughput)
-			lastBytesServed = x
-		}
+	NewStatsReporter([]*Server{m}, time.Second, LogStatsSink{}).Run(context.Background())
+}
 
-		if y > lastBytesReceived {
-			dur := time.Second
-			delta := y - lastBytesReceived
-			bps := float64(delta) / dur.Seconds()
-			throughput := (bps / float64(1024*1024) * 8)
-			if len(msg) > 0 {
-				msg += " "
-			}
-			msg += fmt.Sprintf("Received: %0.2fMbps", throughput)
-			lastBytesReceived = y
-		}
+func (m *Server) generateConfig() {
+	m.generatedConfig = m.buildConfig("")
+}
 
-		if len(msg) > 0 {
-			log.Printf("%s", msg)
+// buildConfig returns the config, with URLs for session if it isn't "".
+func (m *Server) buildConfig(session string) []byte {
+	// inSession adds the session to a URL.
+	inSession := func(u string) string {
+		if len(session) == 0 {
+			return u
 		}
-		time.Sleep(1 * time.Second)
+		separator := "?"
+		if strings.Contains(u, "?") {
+			separator = "&"
+		}
+		return u + separator + url.Values{SessionParameter: {session}}.Encode()
 	}
-}
 
-func (m *Server) generateConfig() {
 	urls := struct {
 		SmallDownloadURL      string `json:"small_download_url"`
 		LargeDownloadURL      string `json:"large_download_url"`
@@ -129,29 +204,140 @@ func (m *Server) generateConfig() {
 		SmallHTTPSDownloadURL string `json:"small_https_download_url"`
 		LargeHTTPSDownloadURL string `json:"large_https_download_url"`
 		HTTPSUploadURL        string `json:"https_upload_url"`
+		ResultsURL            string `json:"results_url,omitempty"`
+		WebSocketDownloadURL  string `json:"websocket_download_url,omitempty"`
+		WebSocketUploadURL    string `json:"websocket_upload_url,omitempty"`
+		WebSocketPingURL      string `json:"websocket_ping_url,omitempty"`
+		WebTransportURL       string `json:"webtransport_url,omitempty"`
+		RawQUICURL            string `json:"raw_quic_url,omitempty"`
+		UDPEchoURL            string `json:"udp_echo_url,omitempty"`
 	}{
-		SmallDownloadURL:      m.generateSmallDownloadURL(),
-		LargeDownloadURL:      m.generateLargeDownloadURL(),
-		UploadURL:             m.generateUploadURL(),
-		SmallHTTPSDownloadURL: m.generateSmallDownloadURL(),
-		LargeHTTPSDownloadURL: m.generateLargeDownloadURL(),
-		HTTPSUploadURL:        m.generateUploadURL(),
+		SmallDownloadURL:      inSession(m.generateSmallDownloadURL()),
+		LargeDownloadURL:      inSession(m.generateLargeDownloadURL()),
+		UploadURL:             inSession(m.generateUploadURL()),
+		SmallHTTPSDownloadURL: inSession(m.generateSmallDownloadURL()),
+		LargeHTTPSDownloadURL: inSession(m.generateLargeDownloadURL()),
+		HTTPSUploadURL:        inSession(m.generateUploadURL()),
+	}
+	if m.EnableResults {
+		urls.ResultsURL = inSession(m.generateURL(m.Scheme, m.PublicHostPort, "/results"))
+	}
+	if m.EnableWebSocket {
+		// WebSocket requests aren't part of sessions.
+		scheme := "ws"
+		if m.Scheme == "https" {
+			scheme = "wss"
+		}
+		urls.WebSocketDownloadURL = m.generateURL(scheme, m.PublicHostPort, "/ws/download")
+		urls.WebSocketUploadURL = m.generateURL(scheme, m.PublicHostPort, "/ws/upload")
+		urls.WebSocketPingURL = m.generateURL(scheme, m.PublicHostPort, "/ws/ping")
+	}
+	if m.EnableWebTransport {
+		urls.WebTransportURL = m.generateURL(m.Scheme, m.PublicHostPort, "/webtransport")
+	}
+	if m.EnableRawQUIC {
+		urls.RawQUICURL = "quic://" + m.PublicHostPort
+	}
+	if len(m.UDPEchoHostPort) > 0 {
+		urls.UDPEchoURL = "udp://" + m.UDPEchoHostPort
+	}
+
+	type congestionControlURLs struct {
+		Algorithm        string `json:"algorithm"`
+		SmallDownloadURL string `json:"small_download_url"`
+		LargeDownloadURL string `json:"large_download_url"`
+		UploadURL        string `json:"upload_url"`
+	}
+
+	var congestionControl []congestionControlURLs
+	for _, e := range m.CongestionControlEndpoints {
+		congestionControl = append(congestionControl, congestionControlURLs{
+			Algorithm:        e.Algorithm,
+			SmallDownloadURL: inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/small")),
+			LargeDownloadURL: inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/large")),
+			UploadURL:        inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/slurp")),
+		})
+	}
+
+	type http1URLs struct {
+		SmallDownloadURL string `json:"small_download_url"`
+		LargeDownloadURL string `json:"large_download_url"`
+		UploadURL        string `json:"upload_url"`
+	}
+
+	type dscpURLs struct {
+		DSCP             string `json:"dscp"`
+		SmallDownloadURL string `json:"small_download_url"`
+		LargeDownloadURL string `json:"large_download_url"`
+		UploadURL        string `json:"upload_url"`
+	}
+
+	// Socket options can only be chosen per request on HTTP/1.1, where
+	// requests don't share their connection.
+	var http1 *http1URLs
+	var dscp []dscpURLs
+	if e := m.HTTP1Endpoint; e != nil {
+		http1 = &http1URLs{
+			SmallDownloadURL: inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/small")),
+			LargeDownloadURL: inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/large")),
+			UploadURL:        inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/slurp")),
+		}
+		for _, marking := range m.DSCPMarkings {
+			query := "?" + url.Values{DSCPParameter: {marking}}.Encode()
+			dscp = append(dscp, dscpURLs{
+				DSCP:             marking,
+				SmallDownloadURL: inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/small"+query)),
+				LargeDownloadURL: inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/large"+query)),
+				UploadURL:        inSession(m.generateURL(e.Scheme, e.PublicHostPort, "/slurp"+query)),
+			})
+		}
 	}
 
 	resp := struct {
-		Version int         `json:"version"`
-		Urls    interface{} `json:"urls"`
+		Version               int                     `json:"version"`
+		Urls                  interface{}             `json:"urls"`
+		CongestionControlURLs []congestionControlURLs `json:"congestion_control_urls,omitempty"`
+		HTTP1URLs             *http1URLs              `json:"http1_urls,omitempty"`
+		DSCPURLs              []dscpURLs              `json:"dscp_urls,omitempty"`
+		Capabilities          []string                `json:"capabilities,omitempty"`
+		Session               string                  `json:"session,omitempty"`
 	}{
-		Version: 1,
-		Urls:    urls,
+		Version:               configVersion,
+		Urls:                  urls,
+		CongestionControlURLs: congestionControl,
+		HTTP1URLs:             http1,
+		DSCPURLs:              dscp,
+		Capabilities:          m.Capabilities,
+		Session:               session,
 	}
 
-	b, err := json.MarshalIndent(resp, "", "    ")
-	if err != nil {
+	// Leave the & of URLs with several parameters alone.
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(resp); err != nil {
 		log.Fatal(err)
 	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
 
-	m.generatedConfig = b
+// TXTRecord returns the DNS-SD TXT record describing m, so that clients can
+// fetch the config without guessing its path and scheme.
+func (m *Server) TXTRecord() map[string]string {
+	txt := map[string]string{
+		"path":    m.ContextPath + "/.well-known/nq",
+		"scheme":  m.Scheme,
+		"version": strconv.Itoa(configVersion),
+		"server":  GitVersion,
+	}
+	if len(m.Protocols) > 0 {
+		txt["protos"] = strings.Join(m.Protocols, ",")
+	}
+	if len(m.Capabilities) > 0 {
+		txt["caps"] = strings.Join(m.Capabilities, ",")
+	}
+	return txt
 }
 
 func (m *Server) ConfigHandler(w http.ResponseWriter, r *http.Request) {
@@ -171,22 +357,33 @@ func (m *Server) ConfigHandler(w http.ResponseWriter, r *http.Request) {
 		setCors(w.Header())
 	}
 
-	_, err := w.Write(m.generatedConfig)
+	config := m.generatedConfig
+	if m.Sessions != nil {
+		if session := m.Sessions.New(remoteIP(r.RemoteAddr)); len(session) > 0 {
+			config = m.buildConfig(session)
+		}
+	}
+
+	_, err := w.Write(config)
 	if err != nil {
 		log.Printf("could not write response: %s", err)
 	}
 }
 
 func (m *Server) generateSmallDownloadURL() string {
-	return fmt.Sprintf("%s://%s%s/small", m.Scheme, m.PublicHostPort, m.ContextPath)
+	return m.generateURL(m.Scheme, m.PublicHostPort, "/small")
 }
 
 func (m *Server) generateLargeDownloadURL() string {
-	return fmt.Sprintf("%s://%s%s/large", m.Scheme, m.PublicHostPort, m.ContextPath)
+	return m.generateURL(m.Scheme, m.PublicHostPort, "/large")
 }
 
 func (m *Server) generateUploadURL() string {
-	return fmt.Sprintf("%s://%s%s/slurp", m.Scheme, m.PublicHostPort, m.ContextPath)
+	return m.generateURL(m.Scheme, m.PublicHostPort, "/slurp")
+}
+
+func (m *Server) generateURL(scheme, hostPort, path string) string {
+	return fmt.Sprintf("%s://%s%s%s", scheme, hostPort, m.ContextPath, path)
 }
 
 func (h *handlers) smallHandler(w http.ResponseWriter, r *http.Request) {
@@ -262,23 +459,48 @@ func setNoPublicCache(h http.Header) {
 	h.Set("Cache-Control", "no-store, must-revalidate, private, max-age=0")
 }
 
-// slurpHandler reads the post request and returns JSON with bytes
-// read and how long it took
+// uploadSummary is the body of the response to an upload.
+type uploadSummary struct {
+	BytesReceived int64 `json:"bytes_received"`
+	DurationMs    int64 `json:"duration_ms"`
+	MPTCP         *bool `json:"mptcp,omitempty"`
+}
+
+// slurpHandler reads the post request. Clients accepting application/json
+// are told how many bytes were read and how long it took.
 func (h *handlers) slurpHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/octet-stream")
+	summarize := strings.Contains(r.Header.Get("Accept"), "application/json")
+	if summarize {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
 	setNoPublicCache(w.Header())
 
 	if h.EnableCORS {
 		setCors((w.Header()))
 	}
 
-	_, err := io.Copy(countingDiscard{byteCounter: h.BytesReceived}, r.Body)
+	start := time.Now()
+	n, err := io.Copy(countingDiscard{byteCounter: h.BytesReceived}, r.Body)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	w.WriteHeader(http.StatusOK)
+	if !summarize {
+		return
+	}
+
+	summary := uploadSummary{
+		BytesReceived: n,
+		DurationMs:    time.Since(start).Milliseconds(),
+		MPTCP:         isMPTCP(r.Context()),
+	}
+	if err := json.NewEncoder(w).Encode(summary); !ignorableError(err) {
+		log.Printf("could not write upload summary: %s", err)
+	}
 }
 
 // countingDiscard implements ReaderFrom as an optimization so Copy to
@@ -322,6 +544,19 @@ func (cb countingDiscard) ReadFrom(r io.Reader) (n int64, err error) {
 	}
 }
 
+// ProtocolName returns the HTTP version r arrived over, as the StatsD tags,
+// sessions and connection list of the server name it: h1, h2, h2c (HTTP/2
+// without TLS) or h3.
+func ProtocolName(r *http.Request) string {
+	switch {
+	case r.ProtoMajor == 2 && r.TLS == nil:
+		return "h2c"
+	case r.ProtoMajor >= 2:
+		return "h" + strconv.Itoa(r.ProtoMajor)
+	}
+	return "h1"
+}
+
 // ignorableError returns true if error does not effect results of clients accessing server
 func ignorableError(err error) bool {
 	if err == nil {
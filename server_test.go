@@ -0,0 +1,103 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestTXTRecord(t *testing.T) {
+	version := strconv.Itoa(configVersion)
+	tests := []struct {
+		name   string
+		server *Server
+		want   map[string]string
+	}{
+		{
+			name:   "minimal",
+			server: &Server{Scheme: "https"},
+			want: map[string]string{
+				"path":    "/.well-known/nq",
+				"scheme":  "https",
+				"version": version,
+				"server":  GitVersion,
+			},
+		},
+		{
+			name: "context path, protocols and capabilities",
+			server: &Server{
+				ContextPath:  "/api/v1",
+				Scheme:       "https",
+				Protocols:    []string{"h2", "h3"},
+				Capabilities: []string{"l4s", "dscp"},
+			},
+			want: map[string]string{
+				"path":    "/api/v1/.well-known/nq",
+				"scheme":  "https",
+				"version": version,
+				"server":  GitVersion,
+				"protos":  "h2,h3",
+				"caps":    "l4s,dscp",
+			},
+		},
+		{
+			name:   "insecure",
+			server: &Server{Scheme: "http", Protocols: []string{"http/1.1", "h2c"}},
+			want: map[string]string{
+				"path":    "/.well-known/nq",
+				"scheme":  "http",
+				"version": version,
+				"server":  GitVersion,
+				"protos":  "http/1.1,h2c",
+			},
+		},
+	}
+	for _, test := range tests {
+		if got := test.server.TXTRecord(); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: TXTRecord() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSlurpHandler(t *testing.T) {
+	tests := []struct {
+		accept      string
+		contentType string
+		summary     bool
+	}{
+		{"", "application/octet-stream", false},
+		{"*/*", "application/octet-stream", false},
+		{"application/json", "application/json", true},
+		{"text/plain, application/json;q=0.9", "application/json", true},
+	}
+	for _, test := range tests {
+		var served, received uint64
+		h := CountingBulkHandlers("", false, &served, &received)["/slurp"]
+		r := httptest.NewRequest(http.MethodPost, "/slurp", strings.NewReader(strings.Repeat("x", 1000)))
+		if len(test.accept) > 0 {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("Accept %q: got %d with %s, want 200 with %s", test.accept, w.Code, w.Header().Get("Content-Type"), test.contentType)
+		}
+		if !test.summary {
+			if w.Body.Len() > 0 {
+				t.Errorf("Accept %q: got body %q, want none", test.accept, w.Body)
+			}
+			continue
+		}
+		var summary uploadSummary
+		if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil || summary.BytesReceived != 1000 {
+			t.Errorf("Accept %q: got summary %q (%v), want 1000 bytes received", test.accept, w.Body, err)
+		}
+	}
+}
@@ -0,0 +1,364 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SessionParameter is the request parameter carrying the session a
+// measurement belongs to, which the config embeds in the URLs it lists when
+// the server tracks sessions, e.g. /large?session=4f2c...
+const SessionParameter = "session"
+
+const (
+	// maxSessions is how many sessions may be active at once; beyond
+	// that, configs are served without one.
+	maxSessions = 100000
+
+	// maxFinishedSessions is how many finished sessions are kept for
+	// queries.
+	maxFinishedSessions = 1000
+)
+
+// A SessionRecord sums up the requests of a test run: those made with the
+// URLs of one config. Bytes include those of requests still in progress.
+type SessionRecord struct {
+	ID         string        `json:"id"`
+	ClientAddr string        `json:"client_addr"`
+	Active     bool          `json:"active"`
+	Start      time.Time     `json:"start"`
+	LastActive time.Time     `json:"last_active"`
+	Duration   time.Duration `json:"duration_ns"`
+
+	Requests      int    `json:"requests"`
+	Connections   int    `json:"connections"`
+	BytesServed   uint64 `json:"bytes_served"`
+	BytesReceived uint64 `json:"bytes_received"`
+
+	// Protocols counts the requests by protocol; see ProtocolName.
+	Protocols map[string]int `json:"protocols"`
+
+	// Handlers breaks the requests down by measurement, e.g. "large".
+	Handlers map[string]SessionHandlerStats `json:"handlers"`
+}
+
+// SessionHandlerStats are the requests of a session for one measurement.
+// Duration is the total time spent on those that completed.
+type SessionHandlerStats struct {
+	Requests      int           `json:"requests"`
+	BytesServed   uint64        `json:"bytes_served"`
+	BytesReceived uint64        `json:"bytes_received"`
+	Duration      time.Duration `json:"duration_ns"`
+}
+
+// A SessionSink receives the records of sessions as they finish.
+type SessionSink interface {
+	Session(SessionRecord) error
+}
+
+// session is an active session. Its fields, but for the byte counters, are
+// guarded by the SessionTracker's mutex.
+type session struct {
+	id         string
+	clientAddr string
+	start      time.Time
+	lastActive time.Time
+	inFlight   int
+	requests   int
+	conns      map[string]struct{}
+	protocols  map[string]int
+	handlers   map[string]*sessionHandler
+}
+
+type sessionHandler struct {
+	requests int
+	duration time.Duration
+	served   atomic.Uint64
+	received atomic.Uint64
+}
+
+func (s *session) record(active bool) SessionRecord {
+	r := SessionRecord{
+		ID:          s.id,
+		ClientAddr:  s.clientAddr,
+		Active:      active,
+		Start:       s.start,
+		LastActive:  s.lastActive,
+		Duration:    s.lastActive.Sub(s.start),
+		Requests:    s.requests,
+		Connections: len(s.conns),
+		Protocols:   make(map[string]int, len(s.protocols)),
+		Handlers:    make(map[string]SessionHandlerStats, len(s.handlers)),
+	}
+	for protocol, n := range s.protocols {
+		r.Protocols[protocol] = n
+	}
+	for name, h := range s.handlers {
+		stats := SessionHandlerStats{
+			Requests:      h.requests,
+			BytesServed:   h.served.Load(),
+			BytesReceived: h.received.Load(),
+			Duration:      h.duration,
+		}
+		r.Handlers[name] = stats
+		r.BytesServed += stats.BytesServed
+		r.BytesReceived += stats.BytesReceived
+	}
+	return r
+}
+
+// A SessionTracker mints a session for each config served and sums up the
+// measurement requests made for it. A session finishes once it has been
+// idle, with no requests in progress, for the idle timeout. Sessions
+// without any requests, e.g. of clients only checking the config, are
+// dropped then.
+type SessionTracker struct {
+	idleTimeout time.Duration
+	sinks       []SessionSink
+
+	mut      sync.Mutex
+	active   map[string]*session
+	finished []SessionRecord
+}
+
+// NewSessionTracker returns a tracker finishing sessions idle for
+// idleTimeout, handing them to sinks, once it runs.
+func NewSessionTracker(idleTimeout time.Duration, sinks ...SessionSink) *SessionTracker {
+	return &SessionTracker{
+		idleTimeout: idleTimeout,
+		sinks:       sinks,
+		active:      make(map[string]*session),
+	}
+}
+
+// New starts a session for the client at clientAddr and returns its ID, or
+// "" if there are too many sessions already.
+func (t *SessionTracker) New(clientAddr string) string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("could not create session: %v", err)
+		return ""
+	}
+	id := hex.EncodeToString(b)
+	now := time.Now()
+
+	t.mut.Lock()
+	defer t.mut.Unlock()
+	if len(t.active) >= maxSessions {
+		return ""
+	}
+	t.active[id] = &session{
+		id:         id,
+		clientAddr: clientAddr,
+		start:      now,
+		lastActive: now,
+		conns:      make(map[string]struct{}),
+		protocols:  make(map[string]int),
+		handlers:   make(map[string]*sessionHandler),
+	}
+	return id
+}
+
+// Handler returns a handler adding the requests for h, the measurement
+// name, to the session they name with SessionParameter, if it is active.
+func (t *SessionTracker) Handler(name string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.URL.Query().Get(SessionParameter)
+		if len(id) == 0 {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		t.mut.Lock()
+		s, ok := t.active[id]
+		if !ok {
+			t.mut.Unlock()
+			h.ServeHTTP(w, r)
+			return
+		}
+		sh := s.handlers[name]
+		if sh == nil {
+			sh = &sessionHandler{}
+			s.handlers[name] = sh
+		}
+		sh.requests++
+		s.requests++
+		s.inFlight++
+		s.lastActive = start
+		s.conns[r.RemoteAddr] = struct{}{}
+		s.protocols[ProtocolName(r)]++
+		t.mut.Unlock()
+
+		if r.Body != nil {
+			r.Body = &sessionBody{ReadCloser: r.Body, received: &sh.received}
+		}
+		sw := NewCountingResponseWriter(w)
+		sw.Served = &sh.served
+		h.ServeHTTP(sw, r)
+
+		end := time.Now()
+		t.mut.Lock()
+		sh.duration += end.Sub(start)
+		s.inFlight--
+		s.lastActive = end
+		t.mut.Unlock()
+	})
+}
+
+// Run finishes idle sessions until ctx is done, and then all of them.
+func (t *SessionTracker) Run(ctx context.Context) {
+	ticker := time.NewTicker(max(t.idleTimeout/4, time.Second))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			t.finish(func(*session) bool { return true })
+			return
+		case now := <-ticker.C:
+			t.finish(func(s *session) bool {
+				return s.inFlight == 0 && now.Sub(s.lastActive) >= t.idleTimeout
+			})
+		}
+	}
+}
+
+// finish finishes the sessions for which done returns true.
+func (t *SessionTracker) finish(done func(*session) bool) {
+	var records []SessionRecord
+	t.mut.Lock()
+	for id, s := range t.active {
+		if !done(s) {
+			continue
+		}
+		delete(t.active, id)
+		if s.requests > 0 {
+			records = append(records, s.record(false))
+		}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+	t.finished = append(t.finished, records...)
+	if extra := len(t.finished) - maxFinishedSessions; extra > 0 {
+		t.finished = append(t.finished[:0], t.finished[extra:]...)
+	}
+	t.mut.Unlock()
+
+	for _, r := range records {
+		for _, sink := range t.sinks {
+			if err := sink.Session(r); err != nil {
+				log.Printf("could not export session: %v", err)
+			}
+		}
+	}
+}
+
+// Sessions returns the records of the active sessions and of the most
+// recently finished ones, by start time.
+func (t *SessionTracker) Sessions() []SessionRecord {
+	t.mut.Lock()
+	records := append([]SessionRecord(nil), t.finished...)
+	for _, s := range t.active {
+		records = append(records, s.record(true))
+	}
+	t.mut.Unlock()
+
+	sort.Slice(records, func(i, j int) bool { return records[i].Start.Before(records[j].Start) })
+	return records
+}
+
+// QueryHandler replies to GET requests with the session records as a JSON
+// array. The id parameter selects a session, and active=true or false the
+// active or finished ones.
+func (t *SessionTracker) QueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	id, active := params.Get("id"), params.Get("active")
+	if len(active) > 0 && active != "true" && active != "false" {
+		http.Error(w, "active must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	records := []SessionRecord{}
+	for _, s := range t.Sessions() {
+		if (len(id) == 0 || s.ID == id) && (len(active) == 0 || (active == "true") == s.Active) {
+			records = append(records, s)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); !ignorableError(err) {
+		log.Printf("could not write sessions: %s", err)
+	}
+}
+
+// sessionBody counts the bytes of a request body.
+type sessionBody struct {
+	io.ReadCloser
+	received *atomic.Uint64
+}
+
+func (b *sessionBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.received.Add(uint64(n))
+	return n, err
+}
+
+// LogSessionSink logs a line for each session.
+type LogSessionSink struct{}
+
+func (LogSessionSink) Session(r SessionRecord) error {
+	log.Printf("session %s from %s: %s, %s", r.ID, r.ClientAddr, r.Duration.Round(time.Millisecond), r)
+	return nil
+}
+
+// String summarizes the requests of r.
+func (r SessionRecord) String() string {
+	var protocols, handlers []string
+	for protocol, n := range r.Protocols {
+		protocols = append(protocols, fmt.Sprintf("%s: %d", protocol, n))
+	}
+	for name, h := range r.Handlers {
+		handlers = append(handlers, fmt.Sprintf("%s: %d (%s)", name, h.Requests, h.Duration.Round(time.Millisecond)))
+	}
+	sort.Strings(protocols)
+	sort.Strings(handlers)
+	return fmt.Sprintf("%d requests on %d connections (%s), sent %d bytes, received %d bytes, %s",
+		r.Requests, r.Connections, strings.Join(protocols, ", "), r.BytesServed, r.BytesReceived, strings.Join(handlers, ", "))
+}
+
+// A JSONSessionSink writes each session record as a line of JSON.
+type JSONSessionSink struct {
+	jsonLines
+}
+
+// NewJSONSessionFileSink returns a sink appending to the file at path,
+// which is created if needed.
+func NewJSONSessionFileSink(path string) (*JSONSessionSink, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONSessionSink{jsonLines{w: f, encoder: json.NewEncoder(f)}}, nil
+}
+
+func (s *JSONSessionSink) Session(r SessionRecord) error {
+	return s.write(r)
+}
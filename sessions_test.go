@@ -0,0 +1,149 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sessionRequest is a measurement request of a session test: its body is
+// upload bytes long, and its response download bytes.
+type sessionRequest struct {
+	handler    string
+	remoteAddr string
+	protoMajor int
+	tls        bool
+	download   int
+	upload     int
+}
+
+type recordingSessionSink []SessionRecord
+
+func (s *recordingSessionSink) Session(r SessionRecord) error {
+	*s = append(*s, r)
+	return nil
+}
+
+func TestSessionTrackerAggregation(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []sessionRequest
+		want     SessionRecord
+	}{
+		{
+			name: "one download",
+			requests: []sessionRequest{
+				{handler: "large", remoteAddr: "192.0.2.1:1000", protoMajor: 2, tls: true, download: 1000},
+			},
+			want: SessionRecord{
+				Requests:    1,
+				Connections: 1,
+				BytesServed: 1000,
+				Protocols:   map[string]int{"h2": 1},
+				Handlers: map[string]SessionHandlerStats{
+					"large": {Requests: 1, BytesServed: 1000},
+				},
+			},
+		},
+		{
+			name: "test run",
+			requests: []sessionRequest{
+				{handler: "small", remoteAddr: "192.0.2.1:1000", protoMajor: 2, tls: true, download: 1},
+				{handler: "large", remoteAddr: "192.0.2.1:1001", protoMajor: 2, tls: true, download: 5000},
+				{handler: "large", remoteAddr: "192.0.2.1:1002", protoMajor: 2, tls: true, download: 7000},
+				{handler: "slurp", remoteAddr: "192.0.2.1:1001", protoMajor: 2, tls: true, upload: 3000},
+				{handler: "small", remoteAddr: "192.0.2.1:1000", protoMajor: 2, tls: true, download: 1},
+				{handler: "small", remoteAddr: "192.0.2.1:1003", protoMajor: 1, download: 1},
+				{handler: "small", remoteAddr: "192.0.2.1:1004", protoMajor: 2, download: 1},
+			},
+			want: SessionRecord{
+				Requests:      7,
+				Connections:   5,
+				BytesServed:   12004,
+				BytesReceived: 3000,
+				Protocols:     map[string]int{"h1": 1, "h2": 5, "h2c": 1},
+				Handlers: map[string]SessionHandlerStats{
+					"small": {Requests: 4, BytesServed: 4},
+					"large": {Requests: 2, BytesServed: 12000},
+					"slurp": {Requests: 1, BytesReceived: 3000},
+				},
+			},
+		},
+	}
+	for _, test := range tests {
+		var sink recordingSessionSink
+		tracker := NewSessionTracker(time.Minute, &sink)
+		id := tracker.New("192.0.2.1:1000")
+
+		for _, req := range test.requests {
+			serveSessionRequest(tracker, id, req)
+		}
+		// Requests without a session, or of another, aren't counted.
+		serveSessionRequest(tracker, "", sessionRequest{handler: "large", remoteAddr: "192.0.2.1:1000", protoMajor: 1, download: 100})
+		serveSessionRequest(tracker, "unknown", sessionRequest{handler: "large", remoteAddr: "192.0.2.1:1000", protoMajor: 1, download: 100})
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		tracker.Run(ctx)
+
+		if len(sink) != 1 {
+			t.Errorf("%s: got %d sessions, want 1", test.name, len(sink))
+			continue
+		}
+		got := sink[0]
+		if got.ID != id || got.ClientAddr != "192.0.2.1:1000" || got.Active {
+			t.Errorf("%s: got session %s of %s (active %t), want %s of 192.0.2.1:1000", test.name, got.ID, got.ClientAddr, got.Active, id)
+		}
+		for name, stats := range got.Handlers {
+			stats.Duration = 0
+			got.Handlers[name] = stats
+		}
+		got.ID, got.ClientAddr, got.Start, got.LastActive, got.Duration = "", "", time.Time{}, time.Time{}, 0
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSessionTrackerDropsUnusedSessions(t *testing.T) {
+	var sink recordingSessionSink
+	tracker := NewSessionTracker(time.Minute, &sink)
+	tracker.New("192.0.2.1:1000")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.Run(ctx)
+
+	if len(sink) != 0 || len(tracker.Sessions()) != 0 {
+		t.Errorf("got sessions %v, %v for a config without requests, want none", sink, tracker.Sessions())
+	}
+}
+
+// serveSessionRequest serves req for the session id, or outside of any if
+// id is empty.
+func serveSessionRequest(tracker *SessionTracker, id string, req sessionRequest) {
+	target := "/" + req.handler
+	if len(id) > 0 {
+		target += "?" + SessionParameter + "=" + id
+	}
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(strings.Repeat("x", req.upload)))
+	r.RemoteAddr = req.remoteAddr
+	r.ProtoMajor = req.protoMajor
+	if req.tls {
+		r.TLS = &tls.ConnectionState{}
+	}
+
+	h := tracker.Handler(req.handler, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Write([]byte(strings.Repeat("x", req.download)))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+}
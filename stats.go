@@ -0,0 +1,243 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ListenerStats is the throughput of a server, or of all of them, as
+// reported by a StatsReporter. Rates are in bits per second (SI, so 1 Mbps
+// is 1,000,000 bits per second).
+type ListenerStats struct {
+	Name   string `json:"name"`
+	Port   int    `json:"port,omitempty"`
+	Scheme string `json:"scheme,omitempty"`
+
+	// BytesServed and BytesReceived are totals; NewBytesServed and
+	// NewBytesReceived are those of the interval reported on.
+	BytesServed      uint64 `json:"bytes_served"`
+	BytesReceived    uint64 `json:"bytes_received"`
+	NewBytesServed   uint64 `json:"new_bytes_served"`
+	NewBytesReceived uint64 `json:"new_bytes_received"`
+
+	SendRate           float64 `json:"send_bps"`
+	ReceiveRate        float64 `json:"receive_bps"`
+	PeakSendRate       float64 `json:"peak_send_bps"`
+	PeakReceiveRate    float64 `json:"peak_receive_bps"`
+	AverageSendRate    float64 `json:"average_send_bps"`
+	AverageReceiveRate float64 `json:"average_receive_bps"`
+}
+
+// A StatsReport is what a StatsReporter hands to its sinks each interval.
+type StatsReport struct {
+	Time time.Time `json:"time"`
+
+	// Interval is the time since the previous report, as measured, and
+	// Elapsed the time since the reporter started. Averages are over
+	// Elapsed.
+	Interval time.Duration `json:"interval_ns"`
+	Elapsed  time.Duration `json:"elapsed_ns"`
+
+	Listeners []ListenerStats `json:"listeners"`
+	Total     ListenerStats   `json:"total"`
+}
+
+// A StatsSink receives the reports of a StatsReporter.
+type StatsSink interface {
+	Report(StatsReport) error
+}
+
+// A StatsReporter periodically reports the throughput of servers to its
+// sinks.
+type StatsReporter struct {
+	servers  []*Server
+	interval time.Duration
+	sinks    []StatsSink
+}
+
+// NewStatsReporter returns a reporter for servers, reporting to sinks every
+// interval once it runs.
+func NewStatsReporter(servers []*Server, interval time.Duration, sinks ...StatsSink) *StatsReporter {
+	return &StatsReporter{servers: servers, interval: interval, sinks: sinks}
+}
+
+// Run reports until ctx is done.
+func (r *StatsReporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	start := time.Now()
+	last := start
+	listeners := make([]ListenerStats, len(r.servers))
+	for i, m := range r.servers {
+		listeners[i] = ListenerStats{
+			Name:          fmt.Sprintf("%s:%d", m.Scheme, m.PublicPort),
+			Port:          m.PublicPort,
+			Scheme:        m.Scheme,
+			BytesServed:   atomic.LoadUint64(&m.BytesServed),
+			BytesReceived: atomic.LoadUint64(&m.BytesReceived),
+		}
+	}
+	initial := append([]ListenerStats(nil), listeners...)
+	total := ListenerStats{Name: "total"}
+	for _, s := range initial {
+		total.BytesServed += s.BytesServed
+		total.BytesReceived += s.BytesReceived
+	}
+	initialTotal := total
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			report := StatsReport{Time: now, Interval: now.Sub(last), Elapsed: now.Sub(start)}
+			last = now
+
+			var served, received uint64
+			for i, m := range r.servers {
+				s := &listeners[i]
+				s.update(atomic.LoadUint64(&m.BytesServed), atomic.LoadUint64(&m.BytesReceived), initial[i], report)
+				served += s.BytesServed
+				received += s.BytesReceived
+			}
+			total.update(served, received, initialTotal, report)
+
+			report.Listeners = append([]ListenerStats(nil), listeners...)
+			report.Total = total
+			for _, sink := range r.sinks {
+				if err := sink.Report(report); err != nil {
+					log.Printf("could not report stats: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// update moves s on to the totals served and received.
+func (s *ListenerStats) update(served, received uint64, initial ListenerStats, report StatsReport) {
+	s.NewBytesServed, s.NewBytesReceived = served-s.BytesServed, received-s.BytesReceived
+	s.BytesServed, s.BytesReceived = served, received
+	s.rates(initial, report)
+}
+
+// rates works out the rates of s from its new bytes and its totals since
+// initial.
+func (s *ListenerStats) rates(initial ListenerStats, report StatsReport) {
+	s.SendRate = bitRate(s.NewBytesServed, report.Interval)
+	s.ReceiveRate = bitRate(s.NewBytesReceived, report.Interval)
+	s.PeakSendRate = max(s.PeakSendRate, s.SendRate)
+	s.PeakReceiveRate = max(s.PeakReceiveRate, s.ReceiveRate)
+	s.AverageSendRate = bitRate(s.BytesServed-initial.BytesServed, report.Elapsed)
+	s.AverageReceiveRate = bitRate(s.BytesReceived-initial.BytesReceived, report.Elapsed)
+}
+
+func bitRate(bytes uint64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return float64(bytes) * 8 / d.Seconds()
+}
+
+// FormatBitRate formats a rate in bits per second with an SI prefix, e.g.
+// "12.34 Mbps".
+func FormatBitRate(bps float64) string {
+	switch {
+	case bps >= 1e9:
+		return fmt.Sprintf("%.2f Gbps", bps/1e9)
+	case bps >= 1e6:
+		return fmt.Sprintf("%.2f Mbps", bps/1e6)
+	case bps >= 1e3:
+		return fmt.Sprintf("%.2f kbps", bps/1e3)
+	}
+	return fmt.Sprintf("%.0f bps", bps)
+}
+
+// LogStatsSink logs the servers that transferred anything in each
+// interval, and the total if there is more than one server.
+type LogStatsSink struct{}
+
+func (LogStatsSink) Report(report StatsReport) error {
+	var active []string
+	for _, s := range report.Listeners {
+		if s.NewBytesServed > 0 || s.NewBytesReceived > 0 {
+			active = append(active, s.String())
+		}
+	}
+	if len(active) == 0 {
+		return nil
+	}
+	if len(report.Listeners) > 1 {
+		active = append(active, report.Total.String())
+	}
+	log.Print(strings.Join(active, "; "))
+	return nil
+}
+
+// String summarizes s as it is logged by LogStatsSink.
+func (s ListenerStats) String() string {
+	return fmt.Sprintf("%s: sent %s (peak %s, average %s), received %s (peak %s, average %s)",
+		s.Name,
+		FormatBitRate(s.SendRate), FormatBitRate(s.PeakSendRate), FormatBitRate(s.AverageSendRate),
+		FormatBitRate(s.ReceiveRate), FormatBitRate(s.PeakReceiveRate), FormatBitRate(s.AverageReceiveRate))
+}
+
+// A JSONStatsSink writes each report as a line of JSON.
+type JSONStatsSink struct {
+	jsonLines
+}
+
+// NewJSONStatsSink returns a sink writing to w.
+func NewJSONStatsSink(w io.Writer) *JSONStatsSink {
+	return &JSONStatsSink{jsonLines{w: w, encoder: json.NewEncoder(w)}}
+}
+
+// NewJSONStatsFileSink returns a sink appending to the file at path, which
+// is created if needed.
+func NewJSONStatsFileSink(path string) (*JSONStatsSink, error) {
+	f, err := openAppend(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONStatsSink(f), nil
+}
+
+func (s *JSONStatsSink) Report(report StatsReport) error {
+	return s.write(report)
+}
+
+// jsonLines writes values as lines of JSON.
+type jsonLines struct {
+	mut     sync.Mutex
+	w       io.Writer
+	encoder *json.Encoder
+}
+
+func (j *jsonLines) write(v any) error {
+	j.mut.Lock()
+	defer j.mut.Unlock()
+	return j.encoder.Encode(v)
+}
+
+// Close closes the writer, if it can be closed.
+func (j *jsonLines) Close() error {
+	if c, ok := j.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// openAppend opens the file at path for appending, creating it if needed.
+func openAppend(path string) (*os.File, error) {
+	return os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+}
@@ -0,0 +1,89 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"testing"
+	"time"
+)
+
+func TestListenerStatsUpdate(t *testing.T) {
+	// A server that had served 1000 and received 500 bytes when the
+	// reporter started.
+	initial := ListenerStats{BytesServed: 1000, BytesReceived: 500}
+	s := initial
+
+	tests := []struct {
+		served, received uint64
+		interval         time.Duration
+		want             ListenerStats
+	}{
+		{
+			served: 1000 + 125000, received: 500 + 12500, interval: time.Second,
+			want: ListenerStats{
+				NewBytesServed: 125000, NewBytesReceived: 12500,
+				SendRate: 1e6, ReceiveRate: 1e5,
+				PeakSendRate: 1e6, PeakReceiveRate: 1e5,
+				AverageSendRate: 1e6, AverageReceiveRate: 1e5,
+			},
+		},
+		{
+			// Twice the rate over half a second.
+			served: 1000 + 250000, received: 500 + 25000, interval: 500 * time.Millisecond,
+			want: ListenerStats{
+				NewBytesServed: 125000, NewBytesReceived: 12500,
+				SendRate: 2e6, ReceiveRate: 2e5,
+				PeakSendRate: 2e6, PeakReceiveRate: 2e5,
+				AverageSendRate: 250000 * 8 / 1.5, AverageReceiveRate: 25000 * 8 / 1.5,
+			},
+		},
+		{
+			// Idle: the peaks remain.
+			served: 1000 + 250000, received: 500 + 25000, interval: 500 * time.Millisecond,
+			want: ListenerStats{
+				PeakSendRate: 2e6, PeakReceiveRate: 2e5,
+				AverageSendRate: 1e6, AverageReceiveRate: 1e5,
+			},
+		},
+		{
+			// An interval of 0 reports no rates rather than dividing by
+			// it.
+			served: 1000 + 250001, received: 500 + 25000, interval: 0,
+			want: ListenerStats{
+				NewBytesServed:  1,
+				PeakSendRate:    2e6,
+				PeakReceiveRate: 2e5,
+				AverageSendRate: 250001 * 8 / 2.0, AverageReceiveRate: 1e5,
+			},
+		},
+	}
+	var elapsed time.Duration
+	for i, test := range tests {
+		elapsed += test.interval
+		s.update(test.served, test.received, initial, StatsReport{Interval: test.interval, Elapsed: elapsed})
+
+		test.want.BytesServed, test.want.BytesReceived = test.served, test.received
+		if s != test.want {
+			t.Errorf("report %d: got %+v, want %+v", i, s, test.want)
+		}
+	}
+}
+
+func TestFormatBitRate(t *testing.T) {
+	tests := []struct {
+		bps  float64
+		want string
+	}{
+		{0, "0 bps"},
+		{999, "999 bps"},
+		{1000, "1.00 kbps"},
+		{12345678, "12.35 Mbps"},
+		{1e9, "1.00 Gbps"},
+		{2.5e12, "2500.00 Gbps"},
+	}
+	for _, test := range tests {
+		if got := FormatBitRate(test.bps); got != test.want {
+			t.Errorf("FormatBitRate(%v) = %q, want %q", test.bps, got, test.want)
+		}
+	}
+}
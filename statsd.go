@@ -0,0 +1,97 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A StatsDClient sends metrics to a StatsD server over UDP. With DogStatsD
+// set, tags are sent in the DogStatsD format; plain StatsD has no tags, so
+// their values are appended to the metric name instead, e.g.
+// "requests.large.h2".
+//
+// A StatsDClient is also a StatsSink, sending the bytes transferred by each
+// server as counters and their rates as gauges.
+type StatsDClient struct {
+	conn      net.Conn
+	prefix    string
+	tags      []string
+	dogStatsD bool
+}
+
+// NewStatsDClient returns a client sending to the server at address
+// (host:port), naming metrics prefix.name. tags ("key:value") are added to
+// every metric.
+func NewStatsDClient(address, prefix string, tags []string, dogStatsD bool) (*StatsDClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	if len(prefix) > 0 && !strings.HasSuffix(prefix, ".") {
+		prefix += "."
+	}
+	return &StatsDClient{conn: conn, prefix: prefix, tags: tags, dogStatsD: dogStatsD}, nil
+}
+
+// Count adds value to the counter name.
+func (c *StatsDClient) Count(name string, value int64, tags ...string) {
+	c.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+// Gauge sets the gauge name to value.
+func (c *StatsDClient) Gauge(name string, value float64, tags ...string) {
+	c.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+// Timing records a duration for the timer name, in milliseconds.
+func (c *StatsDClient) Timing(name string, d time.Duration, tags ...string) {
+	c.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64), "ms", tags)
+}
+
+func (c *StatsDClient) send(name, value, kind string, tags []string) {
+	tags = append(c.tags[:len(c.tags):len(c.tags)], tags...)
+
+	var line string
+	if c.dogStatsD {
+		line = fmt.Sprintf("%s%s:%s|%s", c.prefix, name, value, kind)
+		if len(tags) > 0 {
+			line += "|#" + strings.Join(tags, ",")
+		}
+	} else {
+		for _, tag := range tags {
+			if _, tagValue, ok := strings.Cut(tag, ":"); ok {
+				name += "." + tagValue
+			}
+		}
+		line = fmt.Sprintf("%s%s:%s|%s", c.prefix, name, value, kind)
+	}
+
+	// A full buffer or an absent server are not worth failing over, or
+	// logging every interval while the server is down.
+	_, _ = c.conn.Write([]byte(line))
+}
+
+// Report sends the bytes each server transferred in the interval as
+// bytes_served and bytes_received counters, and their rates in bits per
+// second as send_rate and receive_rate gauges, tagged with the port and
+// scheme. Metrics that can't be sent are dropped.
+func (c *StatsDClient) Report(report StatsReport) error {
+	for _, s := range report.Listeners {
+		tags := []string{"port:" + strconv.Itoa(s.Port), "scheme:" + s.Scheme}
+		c.Count("bytes_served", int64(s.NewBytesServed), tags...)
+		c.Count("bytes_received", int64(s.NewBytesReceived), tags...)
+		c.Gauge("send_rate", s.SendRate, tags...)
+		c.Gauge("receive_rate", s.ReceiveRate, tags...)
+	}
+	return nil
+}
+
+// Close closes the client's socket.
+func (c *StatsDClient) Close() error {
+	return c.conn.Close()
+}
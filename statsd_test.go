@@ -0,0 +1,110 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStatsDClient(t *testing.T) {
+	report := StatsReport{Listeners: []ListenerStats{
+		{Port: 4043, Scheme: "https", NewBytesServed: 1000, NewBytesReceived: 10, SendRate: 8000, ReceiveRate: 80.5},
+	}}
+	tests := []struct {
+		name      string
+		prefix    string
+		tags      []string
+		dogStatsD bool
+		want      []string
+	}{
+		{
+			name: "StatsD",
+			want: []string{
+				"requests.large.h2:1|c",
+				"in_flight:2.5|g",
+				"request_duration.large:12.500|ms",
+				"bytes_served.4043.https:1000|c",
+				"bytes_received.4043.https:10|c",
+				"send_rate.4043.https:8000|g",
+				"receive_rate.4043.https:80.5|g",
+			},
+		},
+		{
+			name:   "StatsD with a prefix and tags",
+			prefix: "nq",
+			tags:   []string{"host:a", "untagged"},
+			want: []string{
+				"nq.requests.a.large.h2:1|c",
+				"nq.in_flight.a:2.5|g",
+				"nq.request_duration.a.large:12.500|ms",
+				"nq.bytes_served.a.4043.https:1000|c",
+				"nq.bytes_received.a.4043.https:10|c",
+				"nq.send_rate.a.4043.https:8000|g",
+				"nq.receive_rate.a.4043.https:80.5|g",
+			},
+		},
+		{
+			name:      "DogStatsD",
+			prefix:    "nq.",
+			dogStatsD: true,
+			want: []string{
+				"nq.requests:1|c|#handler:large,protocol:h2",
+				"nq.in_flight:2.5|g",
+				"nq.request_duration:12.500|ms|#handler:large",
+				"nq.bytes_served:1000|c|#port:4043,scheme:https",
+				"nq.bytes_received:10|c|#port:4043,scheme:https",
+				"nq.send_rate:8000|g|#port:4043,scheme:https",
+				"nq.receive_rate:80.5|g|#port:4043,scheme:https",
+			},
+		},
+		{
+			name:      "DogStatsD with tags",
+			tags:      []string{"host:a"},
+			dogStatsD: true,
+			want: []string{
+				"requests:1|c|#host:a,handler:large,protocol:h2",
+				"in_flight:2.5|g|#host:a",
+				"request_duration:12.500|ms|#host:a,handler:large",
+				"bytes_served:1000|c|#host:a,port:4043,scheme:https",
+				"bytes_received:10|c|#host:a,port:4043,scheme:https",
+				"send_rate:8000|g|#host:a,port:4043,scheme:https",
+				"receive_rate:80.5|g|#host:a,port:4043,scheme:https",
+			},
+		},
+	}
+	for _, test := range tests {
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := NewStatsDClient(pc.LocalAddr().String(), test.prefix, test.tags, test.dogStatsD)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		c.Count("requests", 1, "handler:large", "protocol:h2")
+		c.Gauge("in_flight", 2.5)
+		c.Timing("request_duration", 12500*time.Microsecond, "handler:large")
+		c.Report(report)
+
+		var got []string
+		buf := make([]byte, 1500)
+		for range test.want {
+			pc.SetReadDeadline(time.Now().Add(time.Second))
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				break
+			}
+			got = append(got, string(buf[:n]))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: sent %q, want %q", test.name, got, test.want)
+		}
+		c.Close()
+		pc.Close()
+	}
+}
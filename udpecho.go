@@ -0,0 +1,149 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const (
+	// udpEchoSenderHeader and udpEchoReflectorHeader are the sizes of the
+	// unauthenticated TWAMP-Test packets of RFC 5357, before their padding.
+	udpEchoSenderHeader    = 14
+	udpEchoReflectorHeader = 41
+
+	// udpEchoErrorEstimate is the Error Estimate of the reflected packets:
+	// a clock that isn't known to be synchronized, with the smallest
+	// error multiplier allowed.
+	udpEchoErrorEstimate = 0x0001
+)
+
+// ntpEpochOffset is the number of seconds from 1900, the NTP epoch, to 1970.
+const ntpEpochOffset = 2208988800
+
+// UDPEchoServer reflects UDP test packets in the unauthenticated
+// TWAMP-Test format of RFC 5357 (TWAMP light), for latency measurements
+// without TCP or QUIC. Each reply carries the sender's sequence number,
+// timestamp and TTL, and the times the server received and sent it; its
+// sequence number is the sender's, as in the stateless mode of RFC 8762.
+//
+// Packets shorter than a reply (41 bytes) are dropped, and replies are as
+// long as the packets they reflect, so that spoofed packets can't be
+// amplified. Each client address is limited to Rate packets per second, in
+// bursts of up to Burst packets.
+type UDPEchoServer struct {
+	Rate  float64
+	Burst int
+
+	PacketsReflected   uint64
+	PacketsRateLimited uint64
+	PacketsMalformed   uint64
+}
+
+// Serve reflects the packets read from pc until it is closed.
+func (s *UDPEchoServer) Serve(pc net.PacketConn) error {
+	read := packetReader(pc)
+	limiter := newClientLimiter(s.Rate, s.Burst)
+
+	buf := make([]byte, 65536)
+	reply := make([]byte, 65536)
+	for {
+		n, ttl, addr, err := read(buf)
+		received := time.Now()
+		if errors.Is(err, net.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if n < udpEchoReflectorHeader {
+			atomic.AddUint64(&s.PacketsMalformed, 1)
+			continue
+		}
+		if !allowUDP(limiter, addr, received) {
+			atomic.AddUint64(&s.PacketsRateLimited, 1)
+			continue
+		}
+
+		reflectTWAMP(reply, buf[:n], ttl, received, time.Now())
+		if _, err := pc.WriteTo(reply[:n], addr); err == nil {
+			atomic.AddUint64(&s.PacketsReflected, 1)
+		}
+	}
+}
+
+// reflectTWAMP fills reply, which must be as long as request, with the
+// reflection of request: its sequence number, timestamp, error estimate and
+// ttl, the times it was received and is sent, and the sender's padding, less
+// what the longer header takes up.
+func reflectTWAMP(reply, request []byte, ttl int, received, sent time.Time) {
+	binary.BigEndian.PutUint32(reply[0:], binary.BigEndian.Uint32(request[0:]))
+	binary.BigEndian.PutUint64(reply[4:], ntpTimestamp(sent))
+	binary.BigEndian.PutUint16(reply[12:], udpEchoErrorEstimate)
+	binary.BigEndian.PutUint16(reply[14:], 0)
+	binary.BigEndian.PutUint64(reply[16:], ntpTimestamp(received))
+	copy(reply[24:38], request[:udpEchoSenderHeader])
+	binary.BigEndian.PutUint16(reply[38:], 0)
+	reply[40] = byte(ttl)
+	copy(reply[udpEchoReflectorHeader:len(request)], request[udpEchoReflectorHeader:])
+}
+
+// allowUDP reports whether limiter lets a packet from addr, received at
+// now, through.
+func allowUDP(limiter *clientLimiter, addr net.Addr, now time.Time) bool {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return false
+	}
+	ip, ok := netip.AddrFromSlice(udpAddr.IP)
+	return ok && limiter.allow(ip, now)
+}
+
+// packetReader returns a function reading packets from pc along with their
+// TTL, or hop limit, where the platform reports it, and 0 otherwise.
+func packetReader(pc net.PacketConn) func([]byte) (int, int, net.Addr, error) {
+	if addr, ok := pc.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		p := ipv4.NewPacketConn(pc)
+		if err := p.SetControlMessage(ipv4.FlagTTL, true); err == nil {
+			return func(b []byte) (int, int, net.Addr, error) {
+				n, cm, addr, err := p.ReadFrom(b)
+				if cm == nil {
+					return n, 0, addr, err
+				}
+				return n, cm.TTL, addr, err
+			}
+		}
+	} else if ok {
+		p := ipv6.NewPacketConn(pc)
+		if err := p.SetControlMessage(ipv6.FlagHopLimit, true); err == nil {
+			return func(b []byte) (int, int, net.Addr, error) {
+				n, cm, addr, err := p.ReadFrom(b)
+				if cm == nil {
+					return n, 0, addr, err
+				}
+				return n, cm.HopLimit, addr, err
+			}
+		}
+	}
+	return func(b []byte) (int, int, net.Addr, error) {
+		n, addr, err := pc.ReadFrom(b)
+		return n, 0, addr, err
+	}
+}
+
+// ntpTimestamp returns t in the 64-bit NTP format: seconds since 1900 and
+// their binary fraction.
+func ntpTimestamp(t time.Time) uint64 {
+	seconds := uint64(t.Unix() + ntpEpochOffset)
+	fraction := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return seconds<<32 | fraction
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNTPTimestamp(t *testing.T) {
+	tests := []struct {
+		time time.Time
+		want uint64
+	}{
+		{time.Unix(0, 0), ntpEpochOffset << 32},
+		{time.Unix(1, 500*int64(time.Millisecond)), (ntpEpochOffset+1)<<32 | 1<<31},
+		{time.Unix(0, 250*int64(time.Millisecond)), ntpEpochOffset<<32 | 1<<30},
+		{time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC), 0},
+	}
+	for _, test := range tests {
+		if got := ntpTimestamp(test.time); got != test.want {
+			t.Errorf("ntpTimestamp(%v) = %#x, want %#x", test.time, got, test.want)
+		}
+	}
+}
+
+func TestReflectTWAMP(t *testing.T) {
+	received := time.Unix(1700000000, 0)
+	sent := received.Add(time.Millisecond)
+
+	tests := []struct {
+		name    string
+		padding int
+		ttl     int
+	}{
+		{"shortest", 0, 64},
+		{"padded", 100, 255},
+		{"unknown ttl", 27, 0},
+	}
+	for _, test := range tests {
+		// Sender packets: sequence number, timestamp, error estimate, and
+		// padding up to the length of the reply, and beyond.
+		request := make([]byte, udpEchoReflectorHeader+test.padding)
+		binary.BigEndian.PutUint32(request[0:], 0xdeadbeef)
+		binary.BigEndian.PutUint64(request[4:], 0x0102030405060708)
+		binary.BigEndian.PutUint16(request[12:], 0x8001)
+		for i := udpEchoSenderHeader; i < len(request); i++ {
+			request[i] = byte(i)
+		}
+
+		reply := bytes.Repeat([]byte{0xff}, len(request))
+		reflectTWAMP(reply, request, test.ttl, received, sent)
+
+		fields := []struct {
+			name      string
+			got, want uint64
+		}{
+			{"sequence number", uint64(binary.BigEndian.Uint32(reply[0:])), 0xdeadbeef},
+			{"timestamp", binary.BigEndian.Uint64(reply[4:]), ntpTimestamp(sent)},
+			{"error estimate", uint64(binary.BigEndian.Uint16(reply[12:])), udpEchoErrorEstimate},
+			{"MBZ", uint64(binary.BigEndian.Uint16(reply[14:])), 0},
+			{"receive timestamp", binary.BigEndian.Uint64(reply[16:]), ntpTimestamp(received)},
+			{"sender sequence number", uint64(binary.BigEndian.Uint32(reply[24:])), 0xdeadbeef},
+			{"sender timestamp", binary.BigEndian.Uint64(reply[28:]), 0x0102030405060708},
+			{"sender error estimate", uint64(binary.BigEndian.Uint16(reply[36:])), 0x8001},
+			{"MBZ", uint64(binary.BigEndian.Uint16(reply[38:])), 0},
+			{"sender TTL", uint64(reply[40]), uint64(test.ttl)},
+		}
+		for _, field := range fields {
+			if field.got != field.want {
+				t.Errorf("%s: %s = %#x, want %#x", test.name, field.name, field.got, field.want)
+			}
+		}
+		if got, want := reply[udpEchoReflectorHeader:], request[udpEchoReflectorHeader:]; !bytes.Equal(got, want) {
+			t.Errorf("%s: padding = %x, want %x", test.name, got, want)
+		}
+	}
+}
+
+func TestUDPEchoServer(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &UDPEchoServer{Rate: 1, Burst: 2}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(pc) }()
+	defer func() {
+		pc.Close()
+		if err := <-done; err != nil {
+			t.Errorf("Serve() = %v", err)
+		}
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name   string
+		length int
+		reply  bool
+	}{
+		{"too short", udpEchoReflectorHeader - 1, false},
+		{"shortest", udpEchoReflectorHeader, true},
+		{"padded", 1000, true},
+		{"beyond the burst", udpEchoReflectorHeader, false},
+	}
+	buf := make([]byte, 2000)
+	for i, test := range tests {
+		request := make([]byte, test.length)
+		binary.BigEndian.PutUint32(request, uint32(i))
+		if _, err := conn.Write(request); err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		if !test.reply {
+			if err == nil {
+				t.Errorf("%s: got a %d byte reply, want none", test.name, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if n != test.length || binary.BigEndian.Uint32(buf) != uint32(i) {
+			t.Errorf("%s: got a %d byte reply to %d, want %d bytes to %d", test.name, n, binary.BigEndian.Uint32(buf), test.length, i)
+		}
+	}
+
+	if reflected, limited, malformed := atomic.LoadUint64(&s.PacketsReflected), atomic.LoadUint64(&s.PacketsRateLimited), atomic.LoadUint64(&s.PacketsMalformed); reflected != 2 || limited != 1 || malformed != 1 {
+		t.Errorf("counted %d reflected, %d rate limited and %d malformed packets, want 2, 1 and 1", reflected, limited, malformed)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+// A browser test against the server this page is served by: the idle
+// latency, then the download and upload capacity, each over parallel
+// streams, while probing the latency under load to work out the
+// responsiveness in round-trips per minute (RPM).
+'use strict';
+
+const PHASE_DURATION = 10000; // ms each of download and upload run for
+const STREAMS = 8;            // parallel transfers per direction
+const IDLE_PROBES = 10;
+const PROBE_INTERVAL = 100;   // ms between latency probes under load
+const UPLOAD_SIZE = 32 << 20; // bytes per upload request
+
+const $ = id => document.getElementById(id);
+const sleep = ms => new Promise(resolve => setTimeout(resolve, ms));
+
+let config;
+
+function formatRate(bps) {
+  if (bps >= 1e9) return (bps / 1e9).toFixed(2) + ' Gbps';
+  if (bps >= 1e6) return (bps / 1e6).toFixed(1) + ' Mbps';
+  if (bps >= 1e3) return (bps / 1e3).toFixed(0) + ' kbps';
+  return bps.toFixed(0) + ' bps';
+}
+
+function rating(rpm) {
+  if (rpm < 300) return 'Low';
+  if (rpm < 1000) return 'Medium';
+  return 'High';
+}
+
+// A Meter counts the bytes transferred and samples them to work out rates.
+class Meter {
+  constructor() {
+    this.bytes = 0;
+    this.samples = [[performance.now(), 0]];
+  }
+
+  add(n) {
+    this.bytes += n;
+  }
+
+  sample() {
+    this.samples.push([performance.now(), this.bytes]);
+  }
+
+  // rate returns the rate over about the last window ms, in bits per second.
+  rate(window) {
+    const [now, bytes] = this.samples[this.samples.length - 1];
+    let i = this.samples.length - 1;
+    while (i > 0 && now - this.samples[i - 1][0] <= window) i--;
+    if (i === this.samples.length - 1 && i > 0) i--;
+    const [then, before] = this.samples[i];
+    return now > then ? (bytes - before) * 8 / ((now - then) / 1000) : 0;
+  }
+}
+
+// probe returns how long fetching url took, in ms.
+async function probe(url) {
+  const start = performance.now();
+  const resp = await fetch(url, {cache: 'no-store'});
+  await resp.arrayBuffer();
+  if (!resp.ok) throw new Error(`${url}: ${resp.status} ${resp.statusText}`);
+  return performance.now() - start;
+}
+
+// download keeps fetching url until signal is aborted.
+async function download(url, meter, signal) {
+  while (!signal.aborted) {
+    try {
+      const resp = await fetch(url, {cache: 'no-store', signal});
+      if (!resp.ok) throw new Error(`${url}: ${resp.status} ${resp.statusText}`);
+      const reader = resp.body.getReader();
+      for (;;) {
+        const {done, value} = await reader.read();
+        if (done) break;
+        meter.add(value.byteLength);
+      }
+    } catch (err) {
+      if (signal.aborted) return;
+      throw err;
+    }
+  }
+}
+
+// upload keeps posting to url until signal is aborted. It uses
+// XMLHttpRequest, as fetch can't report the progress of uploads.
+function upload(url, meter, signal) {
+  const body = new Blob([new Uint8Array(UPLOAD_SIZE)]);
+  return new Promise((resolve, reject) => {
+    const send = () => {
+      if (signal.aborted) return resolve();
+      const xhr = new XMLHttpRequest();
+      const abort = () => xhr.abort();
+      let sent = 0;
+      xhr.upload.onprogress = e => {
+        meter.add(e.loaded - sent);
+        sent = e.loaded;
+      };
+      xhr.onload = () => {
+        signal.removeEventListener('abort', abort);
+        if (xhr.status >= 400) return reject(new Error(`${url}: ${xhr.status} ${xhr.statusText}`));
+        send();
+      };
+      xhr.onerror = () => signal.aborted ? resolve() : reject(new Error(`${url}: upload failed`));
+      xhr.onabort = () => resolve();
+      signal.addEventListener('abort', abort, {once: true});
+      xhr.open('POST', url);
+      xhr.send(body);
+    };
+    send();
+  });
+}
+
+// loaded runs transfer over STREAMS streams for PHASE_DURATION, probing the
+// latency meanwhile, and returns the capacity, measured over the second half,
+// and the latencies.
+async function loaded(transfer, url, show) {
+  const meter = new Meter();
+  const controller = new AbortController();
+  const workers = [];
+  for (let i = 0; i < STREAMS; i++) {
+    workers.push(transfer(url, meter, controller.signal));
+  }
+
+  const ticker = setInterval(() => {
+    meter.sample();
+    show(formatRate(meter.rate(2000)));
+  }, 250);
+
+  const latencies = [];
+  let probing = true;
+  const probes = (async () => {
+    while (probing) {
+      latencies.push(await probe(config.urls.small_download_url));
+      await sleep(PROBE_INTERVAL);
+    }
+  })();
+
+  const failed = Promise.race(workers.map(w => w.then(() => new Promise(() => {}))));
+  try {
+    await Promise.race([sleep(PHASE_DURATION), failed, probes]);
+    meter.sample();
+  } finally {
+    probing = false;
+    clearInterval(ticker);
+    controller.abort();
+  }
+  const capacity = meter.rate(PHASE_DURATION / 2);
+
+  for (const result of await Promise.allSettled([...workers, probes])) {
+    if (result.status === 'rejected') throw result.reason;
+  }
+  show(formatRate(capacity));
+  return {capacity, latencies};
+}
+
+// trimmedMean returns the mean of the lowest 90% of values, leaving out
+// the outliers.
+function trimmedMean(values) {
+  const sorted = [...values].sort((a, b) => a - b);
+  const kept = sorted.slice(0, Math.max(1, Math.ceil(sorted.length * 0.9)));
+  return kept.reduce((sum, v) => sum + v, 0) / kept.length;
+}
+
+function median(values) {
+  const sorted = [...values].sort((a, b) => a - b);
+  return sorted[Math.floor(sorted.length / 2)];
+}
+
+// submit sends the result to the server, if it collects them.
+async function submit(result) {
+  if (!config.urls.results_url) return;
+  const platform = navigator.userAgentData ? navigator.userAgentData.platform : navigator.platform;
+  const resp = await fetch(config.urls.results_url, {
+    method: 'POST',
+    headers: {'Content-Type': 'application/json'},
+    body: JSON.stringify({...result, client: {name: 'networkqualityd web', platform}}),
+  });
+  if (!resp.ok) throw new Error(`could not submit result: ${resp.status} ${await resp.text()}`);
+}
+
+// sameOrigin moves url to the origin of the page, as the config names the
+// server by -public-name, which the page may have been reached without.
+function sameOrigin(url) {
+  const u = new URL(url, location.href);
+  u.protocol = location.protocol;
+  u.host = location.host;
+  return u.href;
+}
+
+async function loadConfig() {
+  // The page is served from <context path>/ui/.
+  const resp = await fetch('../.well-known/nq', {cache: 'no-store'});
+  if (!resp.ok) throw new Error(`could not load config: ${resp.status} ${resp.statusText}`);
+  const config = await resp.json();
+  for (const name of ['small_download_url', 'large_download_url', 'upload_url', 'results_url']) {
+    if (config.urls[name]) config.urls[name] = sameOrigin(config.urls[name]);
+  }
+  return config;
+}
+
+async function run() {
+  $('start').disabled = true;
+  for (const id of ['download', 'upload', 'latency', 'rpm', 'rating']) $(id).textContent = id === 'rating' ? '' : '–';
+
+  try {
+    // Every run gets a fresh config, and so session, if the server tracks
+    // them.
+    config = await loadConfig();
+    $('server').textContent = new URL(config.urls.large_download_url).host;
+
+    $('status').textContent = 'Measuring idle latency…';
+    const idle = [];
+    for (let i = 0; i <= IDLE_PROBES; i++) {
+      const latency = await probe(config.urls.small_download_url);
+      // The first probe includes setting up the connection.
+      if (i > 0) idle.push(latency);
+    }
+    const idleLatency = median(idle);
+    $('latency').textContent = idleLatency.toFixed(1) + ' ms';
+
+    $('status').textContent = 'Measuring download…';
+    const down = await loaded(download, config.urls.large_download_url, text => $('download').textContent = text);
+
+    $('status').textContent = 'Measuring upload…';
+    const up = await loaded(upload, config.urls.upload_url, text => $('upload').textContent = text);
+
+    const latencies = [...down.latencies, ...up.latencies];
+    const rpm = Math.round(60000 / trimmedMean(latencies));
+    $('rpm').textContent = rpm + ' RPM';
+    $('rating').textContent = rating(rpm);
+    $('status').textContent = `Done: ${latencies.length} latency probes under load.`;
+
+    await submit({
+      rpm,
+      download_capacity_bps: down.capacity,
+      upload_capacity_bps: up.capacity,
+      idle_latency_ms: idleLatency,
+    });
+  } catch (err) {
+    $('status').textContent = 'Test failed: ' + err.message;
+  } finally {
+    $('start').disabled = false;
+  }
+}
+
+$('start').addEventListener('click', run);
+
+loadConfig().then(c => {
+  config = c;
+  $('server').textContent = new URL(config.urls.large_download_url).host;
+  $('start').disabled = false;
+}, err => {
+  $('server').textContent = 'unavailable';
+  $('status').textContent = err.message;
+});
@@ -0,0 +1,152 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// maxPingSize is the largest ping message echoed.
+	maxPingSize = 1024
+
+	// uploadProgressInterval is how often the WebSocket upload sink tells
+	// the client how much it received.
+	uploadProgressInterval = 250 * time.Millisecond
+)
+
+// CountingWebSocketHandlers returns path, handler tuples with the provided
+// prefix for WebSocket measurements, counting the bytes of their messages
+// in bytesServed and bytesReceived:
+//
+//   - /ws/download floods the client with binary messages until it closes
+//     the connection.
+//   - /ws/upload discards the messages it receives, and sends a JSON text
+//     message with the bytes received so far every 250ms.
+//   - /ws/ping echoes each message as it is, for latency probes.
+//
+// Browsers may only connect from pages of the server itself unless
+// EnableCORS is set.
+func CountingWebSocketHandlers(prefix string, EnableCORS bool, bytesServed, bytesReceived *uint64) map[string]http.Handler {
+	h := &handlers{EnableCORS: EnableCORS, BytesServed: bytesServed, BytesReceived: bytesReceived}
+	return map[string]http.Handler{
+		prefix + "/ws/download": websocket.Server{Handler: h.webSocketDownload, Handshake: h.checkOrigin},
+		prefix + "/ws/upload":   websocket.Server{Handler: h.webSocketUpload, Handshake: h.checkOrigin},
+		prefix + "/ws/ping":     websocket.Server{Handler: h.webSocketPing, Handshake: h.checkOrigin},
+	}
+}
+
+// checkOrigin accepts clients without an Origin, which aren't browsers, and
+// browsers on pages of this server, or anywhere with EnableCORS.
+func (h *handlers) checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin, err := websocket.Origin(config, r)
+	if err != nil {
+		return err
+	}
+	config.Origin = origin
+	if origin == nil || h.EnableCORS || origin.Host == r.Host {
+		return nil
+	}
+	return fmt.Errorf("origin %s not allowed", origin)
+}
+
+func (h *handlers) webSocketDownload(ws *websocket.Conn) {
+	defer ws.Close()
+
+	// Stop as soon as the client closes the connection, rather than when
+	// a write eventually fails.
+	go func() {
+		_, _ = io.Copy(io.Discard, ws)
+		ws.Close()
+	}()
+
+	ws.PayloadType = websocket.BinaryFrame
+	for {
+		n, err := ws.Write(buffed)
+		atomic.AddUint64(h.BytesServed, uint64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// webSocketUploadProgress is the message the upload sink sends.
+type webSocketUploadProgress struct {
+	BytesReceived int64 `json:"bytes_received"`
+	DurationMs    int64 `json:"duration_ms"`
+}
+
+func (h *handlers) webSocketUpload(ws *websocket.Conn) {
+	defer ws.Close()
+
+	start := time.Now()
+	var received atomic.Int64
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(uploadProgressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				progress := webSocketUploadProgress{BytesReceived: received.Load(), DurationMs: time.Since(start).Milliseconds()}
+				if err := websocket.JSON.Send(ws, progress); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	buf := make([]byte, chunkSize)
+	for {
+		n, err := ws.Read(buf)
+		received.Add(int64(n))
+		atomic.AddUint64(h.BytesReceived, uint64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// webSocketMessage is a message of either type, for echoing.
+type webSocketMessage struct {
+	data        []byte
+	payloadType byte
+}
+
+var echoCodec = websocket.Codec{
+	Marshal: func(v interface{}) ([]byte, byte, error) {
+		m := v.(*webSocketMessage)
+		return m.data, m.payloadType, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v interface{}) error {
+		m := v.(*webSocketMessage)
+		m.data, m.payloadType = data, payloadType
+		return nil
+	},
+}
+
+func (h *handlers) webSocketPing(ws *websocket.Conn) {
+	defer ws.Close()
+
+	ws.MaxPayloadBytes = maxPingSize
+	for {
+		var m webSocketMessage
+		if err := echoCodec.Receive(ws, &m); err != nil {
+			return
+		}
+		atomic.AddUint64(h.BytesReceived, uint64(len(m.data)))
+		if err := echoCodec.Send(ws, &m); err != nil {
+			return
+		}
+		atomic.AddUint64(h.BytesServed, uint64(len(m.data)))
+	}
+}
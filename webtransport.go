@@ -0,0 +1,207 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/quic-go/webtransport-go"
+)
+
+// CountingWebTransportHandlers returns path, handler tuples with the
+// provided prefix for WebTransport measurements, which server upgrades
+// HTTP/3 requests to, counting their bytes in bytesServed and
+// bytesReceived. In a session at /webtransport:
+//
+//   - every byte the client sends on a bidirectional stream asks for a
+//     download: the server opens a unidirectional stream and floods it until
+//     the client stops reading. The server sends nothing on bidirectional
+//     streams.
+//   - every unidirectional stream the client opens is an upload, which the
+//     server discards.
+//   - every datagram the client sends is echoed, with the time the server
+//     received it appended as nanoseconds since the Unix epoch (8 bytes, big
+//     endian), for latency probes.
+//
+// Browsers may only connect from pages of the server itself unless
+// EnableCORS is set; server's CheckOrigin is set accordingly. Its QUIC
+// listener must enable datagrams.
+func CountingWebTransportHandlers(prefix string, EnableCORS bool, server *webtransport.Server, bytesServed, bytesReceived *uint64) map[string]http.Handler {
+	server.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		if len(origin) == 0 || EnableCORS {
+			return true
+		}
+		u, err := url.Parse(origin)
+		return err == nil && strings.EqualFold(u.Host, r.Host)
+	}
+
+	h := &webTransportHandler{
+		server:        server,
+		bytesServed:   bytesServed,
+		bytesReceived: bytesReceived,
+		conns:         make(map[quic.Connection]map[uint64]struct{}),
+	}
+	return map[string]http.Handler{
+		prefix + "/webtransport": h,
+	}
+}
+
+type webTransportHandler struct {
+	server        *webtransport.Server
+	bytesServed   *uint64
+	bytesReceived *uint64
+
+	// conns holds the sessions of each connection, by the quarter stream
+	// ID that identifies them in datagrams.
+	mut   sync.Mutex
+	conns map[quic.Connection]map[uint64]struct{}
+}
+
+// ServeHTTP serves a session until it is closed.
+func (h *webTransportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodConnect {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := h.server.Upgrade(w, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer session.CloseWithError(0, "")
+
+	// Datagrams name their session by the stream of its CONNECT request.
+	streamer, ok := r.Body.(http3.HTTPStreamer)
+	if !ok {
+		return
+	}
+	conn, ok := w.(http3.Hijacker).StreamCreator().(quic.Connection)
+	if !ok {
+		return
+	}
+	quarterStreamID := uint64(streamer.HTTPStream().StreamID()) / 4
+	h.addSession(conn, quarterStreamID)
+	defer h.removeSession(conn, quarterStreamID)
+
+	ctx := session.Context()
+	go func() {
+		for {
+			str, err := session.AcceptUniStream(ctx)
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(countingDiscard{byteCounter: h.bytesReceived}, str)
+			}()
+		}
+	}()
+
+	for {
+		str, err := session.AcceptStream(ctx)
+		if err != nil {
+			return
+		}
+		go h.serveDownloads(session, str)
+	}
+}
+
+// serveDownloads opens a download for every byte the client sends on str,
+// until the client closes it or the session ends.
+func (h *webTransportHandler) serveDownloads(session *webtransport.Session, str webtransport.Stream) {
+	str.Close()
+	buf := make([]byte, 64)
+	for {
+		n, err := str.Read(buf)
+		for i := 0; i < n; i++ {
+			download, err := session.OpenUniStreamSync(session.Context())
+			if err != nil {
+				str.CancelRead(0)
+				return
+			}
+			go h.download(download)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// download floods str until the client stops reading it or the session
+// ends.
+func (h *webTransportHandler) download(str webtransport.SendStream) {
+	for {
+		n, err := str.Write(buffed)
+		atomic.AddUint64(h.bytesServed, uint64(n))
+		if err != nil {
+			return
+		}
+	}
+}
+
+// addSession starts echoing the datagrams of a session, reading those of
+// its connection if nobody does yet.
+func (h *webTransportHandler) addSession(conn quic.Connection, quarterStreamID uint64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	sessions, ok := h.conns[conn]
+	if !ok {
+		sessions = make(map[uint64]struct{})
+		h.conns[conn] = sessions
+		go h.echoDatagrams(conn)
+	}
+	sessions[quarterStreamID] = struct{}{}
+}
+
+func (h *webTransportHandler) removeSession(conn quic.Connection, quarterStreamID uint64) {
+	h.mut.Lock()
+	defer h.mut.Unlock()
+	delete(h.conns[conn], quarterStreamID)
+}
+
+// echoDatagrams echoes the datagrams of the sessions on conn until it is
+// closed.
+func (h *webTransportHandler) echoDatagrams(conn quic.Connection) {
+	defer func() {
+		h.mut.Lock()
+		delete(h.conns, conn)
+		h.mut.Unlock()
+	}()
+
+	for {
+		datagram, err := conn.ReceiveMessage(conn.Context())
+		if err != nil {
+			return
+		}
+		received := time.Now()
+
+		quarterStreamID, err := quicvarint.Read(bytes.NewReader(datagram))
+		if err != nil {
+			continue
+		}
+		h.mut.Lock()
+		_, ok := h.conns[conn][quarterStreamID]
+		h.mut.Unlock()
+		if !ok {
+			continue
+		}
+
+		header := int(quicvarint.Len(quarterStreamID))
+		atomic.AddUint64(h.bytesReceived, uint64(len(datagram)-header))
+		reply := appendTimestamp(datagram, received)
+		if err := conn.SendMessage(reply); err == nil {
+			atomic.AddUint64(h.bytesServed, uint64(len(reply)-header))
+		}
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/quic-go/quic-go/quicvarint"
+	"github.com/quic-go/webtransport-go"
+)
+
+// webTransportTest is a WebTransport measurement session with an in-process
+// server.
+type webTransportTest struct {
+	session                    *webtransport.Session
+	conn                       quic.EarlyConnection
+	bytesServed, bytesReceived uint64
+}
+
+func newWebTransportTest(t *testing.T) *webTransportTest {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	// Borrow the certificate of httptest, which is valid for 127.0.0.1.
+	certServer := httptest.NewTLSServer(nil)
+	certServer.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(certServer.Certificate())
+
+	test := &webTransportTest{}
+	wt := &webtransport.Server{H3: http3.Server{
+		TLSConfig:  &tls.Config{Certificates: certServer.TLS.Certificates},
+		QuicConfig: &quic.Config{EnableDatagrams: true},
+	}}
+	mux := http.NewServeMux()
+	for pattern, handler := range CountingWebTransportHandlers("", false, wt, &test.bytesServed, &test.bytesReceived) {
+		mux.Handle(pattern, handler)
+	}
+	wt.H3.Handler = mux
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go wt.Serve(pc)
+	t.Cleanup(func() { wt.Close() })
+
+	dialer := &webtransport.Dialer{RoundTripper: &http3.RoundTripper{
+		TLSClientConfig: &tls.Config{RootCAs: roots},
+		Dial: func(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (quic.EarlyConnection, error) {
+			conn, err := quic.DialAddrEarly(ctx, addr, tlsConf, conf)
+			test.conn = conn
+			return conn, err
+		},
+	}}
+	t.Cleanup(func() { dialer.Close() })
+	_, test.session, err = dialer.Dial(ctx, fmt.Sprintf("https://%s/webtransport", pc.LocalAddr()), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return test
+}
+
+func TestWebTransportDownload(t *testing.T) {
+	test := newWebTransportTest(t)
+	ctx := test.session.Context()
+
+	requests, err := test.session.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := requests.Write([]byte{0, 0}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		download, err := test.session.AcceptUniStream(ctx)
+		cancel()
+		if err != nil {
+			t.Fatalf("download %d: %v", i, err)
+		}
+		n, err := io.CopyN(io.Discard, download, 1<<20)
+		if err != nil {
+			t.Errorf("download %d: got %d bytes, %v", i, n, err)
+		}
+		download.CancelRead(0)
+	}
+	if served := atomic.LoadUint64(&test.bytesServed); served < 2<<20 {
+		t.Errorf("counted %d bytes served, want at least %d", served, 2<<20)
+	}
+
+	// Nothing is sent on the stream requesting downloads.
+	requests.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if n, err := requests.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read %d bytes, %v from the request stream, want EOF", n, err)
+	}
+}
+
+func TestWebTransportUpload(t *testing.T) {
+	test := newWebTransportTest(t)
+
+	upload, err := test.session.OpenUniStreamSync(test.session.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(upload, strings.NewReader(strings.Repeat("x", 100000))); err != nil {
+		t.Fatal(err)
+	}
+	upload.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadUint64(&test.bytesReceived) < 100000 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if received := atomic.LoadUint64(&test.bytesReceived); received != 100000 {
+		t.Errorf("counted %d bytes received, want 100000", received)
+	}
+}
+
+func TestWebTransportDatagrams(t *testing.T) {
+	test := newWebTransportTest(t)
+
+	// The session is the first request of its connection, on stream 0.
+	probe := quicvarint.Append(nil, 0)
+	probe = append(probe, "probe"...)
+	before := time.Now()
+	if err := test.conn.SendMessage(probe); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(test.session.Context(), 5*time.Second)
+	defer cancel()
+	reply, err := test.conn.ReceiveMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != len(probe)+8 || !bytes.Equal(reply[:len(probe)], probe) {
+		t.Fatalf("got reply %x to %x, want it with a timestamp appended", reply, probe)
+	}
+	received := time.Unix(0, int64(binary.BigEndian.Uint64(reply[len(probe):])))
+	if received.Before(before) || received.After(time.Now()) {
+		t.Errorf("got receive time %v, want between %v and now", received, before)
+	}
+
+	// Datagrams of other sessions are dropped.
+	if err := test.conn.SendMessage(append(quicvarint.Append(nil, 1), "probe"...)); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(test.session.Context(), 200*time.Millisecond)
+	defer cancel()
+	if reply, err := test.conn.ReceiveMessage(ctx); err == nil {
+		t.Errorf("got reply %x to a datagram of another session", reply)
+	}
+}
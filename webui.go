@@ -0,0 +1,32 @@
+// Copyright (c) 2021-2023 Apple Inc. Licensed under MIT License.
+
+package goserver
+
+import (
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// WebUIHandler returns a handler serving, under prefix + "/ui/", a page
+// testing the server from a browser with the URLs of its config.
+func WebUIHandler(prefix string) http.Handler {
+	files, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		log.Fatal(err)
+	}
+	fileServer := http.StripPrefix(prefix+"/ui/", http.FileServer(http.FS(files)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		// Pick up new versions of the page after an upgrade.
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}